@@ -0,0 +1,705 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+ * A local HTTP server with JSON endpoints to control the machine and a
+ * Server-Sent Events stream of state changes and serial output.
+ *
+ *   GET    /state                     registers, MAR, MBR, MPC, state and cycles
+ *   POST   /load/microcode?format=    body is a microcode image, format is auto or a decoder name
+ *   POST   /load/memory?format=&base= body is a memory image, format is auto or a decoder name
+ *   POST   /step?count=n              executes n microinstructions
+ *   POST   /step?instructions=n       executes n macro instructions
+ *   POST   /run, /halt, /reset
+ *   GET    /registers                 all registers by name
+ *   PUT    /registers                 {"AC": 5, ...}
+ *   GET    /memory?addr=&count=       words starting at addr
+ *   PUT    /memory                    {"addr": 100, "values": [1, 2]}
+ *   GET    /breakpoints               {"pc": [...], "mpc": [...]}
+ *   POST   /breakpoints, DELETE       adds or removes the listed breakpoints
+ *   POST   /input                     {"text": "..."} sent to the serial receiver
+ *   GET    /events                    "state" and "output" events
+ */
+
+type APIServer struct {
+	Mic *mic1
+	/* Microcode and memory reload functions used by reset */
+	MR  func(m *mic1) error
+	MCR func(m *mic1) error
+
+	lock sync.Mutex
+	subs map[chan apiEvent]bool
+}
+
+type apiEvent struct {
+	Name string
+	Data interface{}
+}
+
+type apiState struct {
+	State     string            `json:"state"`
+	Registers map[string]uint16 `json:"registers"`
+	MPC       uint8             `json:"mpc"`
+	Cycles    uint64            `json:"cycles"`
+	Error     string            `json:"error,omitempty"`
+}
+
+type apiBreakpoints struct {
+	PC  []uint16 `json:"pc"`
+	MPC []int    `json:"mpc"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+/* Serves the API on addr, an address without a host only listens on localhost */
+func (a *APIServer) ListenAndServe(addr string) error {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	a.subs = make(map[chan apiEvent]bool)
+	a.Mic.TakeSnapshot(LOADED_SNAPSHOT)
+	states, _ := a.Mic.Subscribe()
+	go a.watch(states)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", a.handleState)
+	mux.HandleFunc("/load/microcode", a.handleLoadMC)
+	mux.HandleFunc("/load/memory", a.handleLoadMem)
+	mux.HandleFunc("/step", a.handleStep)
+	mux.HandleFunc("/run", a.handleRun)
+	mux.HandleFunc("/halt", a.handleHalt)
+	mux.HandleFunc("/reset", a.handleReset)
+	mux.HandleFunc("/registers", a.handleRegisters)
+	mux.HandleFunc("/memory", a.handleMemory)
+	mux.HandleFunc("/export/memory", a.handleExportMem)
+	mux.HandleFunc("/export/microcode", a.handleExportMC)
+	mux.HandleFunc("/snapshot", a.handleSnapshot)
+	mux.HandleFunc("/diff", a.handleDiff)
+	mux.HandleFunc("/breakpoints", a.handleBreakpoints)
+	mux.HandleFunc("/input", a.handleInput)
+	mux.HandleFunc("/events", a.handleEvents)
+	log.Println("Serving the HTTP API on", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+/* Publishes state changes and serial output to every event stream */
+func (a *APIServer) watch(states <-chan int) {
+	/* a serial backend owns the serial port */
+	output := a.Mic.Output
+	if a.Mic.SerialExternal {
+		output = nil
+	}
+	for {
+		select {
+		case state := <-states:
+			/* the machine may have moved on, report the state that was sent */
+			s := a.state()
+			s.State = "halt"
+			if state == RUN {
+				s.State = "run"
+			}
+			a.publish("state", s)
+		case out := <-output:
+			a.publish("output", map[string]string{"text": out})
+		}
+	}
+}
+
+func (a *APIServer) publish(name string, data interface{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for c := range a.subs {
+		select {
+		case c <- apiEvent{name, data}:
+		default:
+			/* drop events for clients that are not keeping up */
+		}
+	}
+}
+
+func (a *APIServer) state() apiState {
+	m := a.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	s := apiState{State: "halt", Registers: make(map[string]uint16), MPC: m.MPC, Cycles: m.Cycles}
+	if m.Running() {
+		s.State = "run"
+	}
+	if m.Fault != nil {
+		s.Error = m.Fault.Error()
+	}
+	for i, v := range m.Registers {
+		s.Registers[RegIdToNames[i]] = v
+	}
+	s.Registers["MAR"] = m.MAR
+	s.Registers["MBR"] = m.MBR
+	return s
+}
+
+func apiWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiFail(w http.ResponseWriter, status int, err error) {
+	apiWrite(w, status, apiError{err.Error()})
+}
+
+/* Returns the base query parameter as a memory address, 0 when it isn't given */
+func apiBase(r *http.Request) (uint16, error) {
+	b := r.URL.Query().Get("base")
+	if b == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(b, 0, 16)
+	if err != nil || v >= 4096 {
+		return 0, errors.New("base must be a memory address")
+	}
+	return uint16(v), nil
+}
+
+/* Checks the request method, replying with an error if it is not one of methods */
+func apiMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, v := range methods {
+		if r.Method == v {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	apiFail(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("method %s not allowed", r.Method)))
+	return false
+}
+
+/* Replies with an error if the machine is running */
+func (a *APIServer) halted(w http.ResponseWriter) bool {
+	if a.Mic.Running() {
+		apiFail(w, http.StatusConflict, errors.New("the machine is running"))
+		return false
+	}
+	return true
+}
+
+/* Parses an optional integer query parameter */
+func apiInt(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("bad %s \"%s\"", name, s))
+	}
+	return int(v), nil
+}
+
+func (a *APIServer) handleState(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET") {
+		return
+	}
+	apiWrite(w, http.StatusOK, a.state())
+}
+
+func (a *APIServer) handleLoadMC(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") || !a.halted(w) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	img, err := DecodeMC(body, "request body", r.URL.Query().Get("format"))
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	a.Mic.Reload(func(m *mic1) error {
+		m.ZeroMC()
+		m.LoadMCImage(img)
+		a.MCR = func(m *mic1) error {
+			m.LoadMCImage(img)
+			return nil
+		}
+		return nil
+	})
+	apiWrite(w, http.StatusOK, map[string]int{"loaded": len(img.Words), "labels": len(img.Labels)})
+}
+
+func (a *APIServer) handleLoadMem(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") || !a.halted(w) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	base, err := apiBase(r)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	img, err := DecodeMem(body, "request body", r.URL.Query().Get("format"))
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	img.Relocate(base)
+	err = a.Mic.Reload(func(m *mic1) error {
+		/* memory is left alone if the image doesn't fit */
+		loaded := new(mic1)
+		if err := loaded.LoadImage(img); err != nil {
+			return err
+		}
+		m.Memory = loaded.Memory
+		m.MemSymbols = img.Symbols
+		m.LineMap = nil
+		m.TakeSnapshot(LOADED_SNAPSHOT)
+		a.MR = func(m *mic1) error {
+			m.MemSymbols = img.Symbols
+			m.LineMap = nil
+			return m.LoadImage(img)
+		}
+		return nil
+	})
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiWrite(w, http.StatusOK, map[string]int{"loaded": img.Len(), "segments": len(img.Segments), "symbols": len(img.Symbols)})
+}
+
+func (a *APIServer) handleStep(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") || !a.halted(w) {
+		return
+	}
+	count, err := apiInt(r, "count", 1)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	instructions, err := apiInt(r, "instructions", 0)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if instructions > 0 {
+		for i := 0; i < instructions && err == nil; i++ {
+			err = a.Mic.StepInstruction(GDB_STEP_LIMIT)
+		}
+	} else {
+		for i := 0; i < count && err == nil; i++ {
+			err = a.Mic.Step()
+		}
+	}
+	if err == ErrRunning {
+		apiFail(w, http.StatusConflict, err)
+		return
+	}
+	/* any other error halted the step early and is in the state */
+	s := a.state()
+	a.publish("state", s)
+	apiWrite(w, http.StatusOK, s)
+}
+
+func (a *APIServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") || !a.halted(w) {
+		return
+	}
+	if _, err := a.Mic.Start(context.Background(), nil); err != nil {
+		apiFail(w, http.StatusConflict, err)
+		return
+	}
+	apiWrite(w, http.StatusAccepted, map[string]string{"state": "run"})
+}
+
+func (a *APIServer) handleHalt(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") {
+		return
+	}
+	a.Mic.Halt()
+	apiWrite(w, http.StatusAccepted, map[string]string{"state": "halt"})
+}
+
+func (a *APIServer) handleReset(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") || !a.halted(w) {
+		return
+	}
+	err := a.Mic.Reload(func(m *mic1) error {
+		m.resetRegisters()
+		m.ZeroMem()
+		m.ZeroMC()
+		if a.MCR != nil {
+			if err := a.MCR(m); err != nil {
+				return err
+			}
+		}
+		if a.MR != nil {
+			if err := a.MR(m); err != nil {
+				return err
+			}
+		}
+		m.TakeSnapshot(LOADED_SNAPSHOT)
+		return nil
+	})
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	s := a.state()
+	a.publish("state", s)
+	apiWrite(w, http.StatusOK, s)
+}
+
+func (a *APIServer) handleRegisters(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET", "PUT") {
+		return
+	}
+	if r.Method == "PUT" {
+		if !a.halted(w) {
+			return
+		}
+		regs := make(map[string]uint16)
+		if err := json.NewDecoder(r.Body).Decode(&regs); err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		m := a.Mic
+		m.RegistersLock.Lock()
+		/* check every name before writing any */
+		for name := range regs {
+			if _, ok := m.Register(name); !ok {
+				m.RegistersLock.Unlock()
+				apiFail(w, http.StatusBadRequest, errors.New(fmt.Sprintf("unknown register \"%s\"", name)))
+				return
+			}
+		}
+		for name, v := range regs {
+			m.SetRegister(name, v)
+		}
+		m.RegistersLock.Unlock()
+	}
+	apiWrite(w, http.StatusOK, a.state().Registers)
+}
+
+func (a *APIServer) handleMemory(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET", "PUT") {
+		return
+	}
+	m := a.Mic
+	if r.Method == "PUT" {
+		if !a.halted(w) {
+			return
+		}
+		var req struct {
+			Addr   int      `json:"addr"`
+			Values []uint16 `json:"values"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Addr < 0 || req.Addr+len(req.Values) > len(m.Memory) {
+			apiFail(w, http.StatusBadRequest, errors.New("address out of range"))
+			return
+		}
+		m.RegistersLock.Lock()
+		copy(m.Memory[req.Addr:], req.Values)
+		m.RegistersLock.Unlock()
+		apiWrite(w, http.StatusOK, map[string]int{"written": len(req.Values)})
+		return
+	}
+	addr, err := apiInt(r, "addr", 0)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	count, err := apiInt(r, "count", 1)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if addr < 0 || count < 0 || addr+count > len(m.Memory) {
+		apiFail(w, http.StatusBadRequest, errors.New("address out of range"))
+		return
+	}
+	m.RegistersLock.Lock()
+	values := make([]uint16, count)
+	copy(values, m.Memory[addr:addr+count])
+	m.RegistersLock.Unlock()
+	apiWrite(w, http.StatusOK, map[string]interface{}{"addr": addr, "values": values})
+}
+
+/* Writes memory in the format given, a hex dump by default, limited to ranges=from..to,... */
+func (a *APIServer) handleExportMem(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET") {
+		return
+	}
+	m := a.Mic
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "dump"
+	}
+	enc := FindMemDecoder(format)
+	if enc == nil {
+		apiFail(w, http.StatusBadRequest, errors.New(fmt.Sprintf("unknown memory format \"%s\", use %s", format, MemFormatNames())))
+		return
+	}
+	var args []string
+	if rs := q.Get("ranges"); rs != "" {
+		args = strings.Split(rs, ",")
+	}
+	m.RegistersLock.Lock()
+	ranges, err := m.ParseRanges(args)
+	img := m.MemImageOf(ranges)
+	m.RegistersLock.Unlock()
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	enc.Encode(w, img)
+}
+
+/* Writes the microcode in the format given, binary strings by default */
+func (a *APIServer) handleExportMC(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET") {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "mcs"
+	}
+	enc := FindMCDecoder(format)
+	if enc == nil {
+		apiFail(w, http.StatusBadRequest, errors.New(fmt.Sprintf("unknown microcode format \"%s\", use %s", format, MCFormatNames())))
+		return
+	}
+	a.Mic.RegistersLock.Lock()
+	img := a.Mic.MCImageOf()
+	a.Mic.RegistersLock.Unlock()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	enc.Encode(w, img)
+}
+
+func (a *APIServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "snap"
+	}
+	a.Mic.RegistersLock.Lock()
+	a.Mic.TakeSnapshot(name)
+	a.Mic.RegistersLock.Unlock()
+	apiWrite(w, http.StatusOK, map[string]string{"snapshot": name})
+}
+
+/*
+ * Lists the words that differ from a snapshot, GET ?snapshot=name defaulting
+ * to memory as loaded, or from the memory image in a POST body at ?base=.
+ */
+func (a *APIServer) handleDiff(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET", "POST") {
+		return
+	}
+	m := a.Mic
+	q := r.URL.Query()
+	var ref *MemImage
+	name := ""
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		base, err := apiBase(r)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		ref, err = DecodeMem(body, "request body", q.Get("format"))
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		ref.Relocate(base)
+	} else if name = q.Get("snapshot"); name == "" {
+		name = LOADED_SNAPSHOT
+	}
+	var args []string
+	if rs := q.Get("ranges"); rs != "" {
+		args = strings.Split(rs, ",")
+	}
+	type apiChange struct {
+		Addr uint16 `json:"addr"`
+		Name string `json:"name"`
+		Old  uint16 `json:"old"`
+		New  uint16 `json:"new"`
+	}
+	ret := make([]apiChange, 0)
+	m.RegistersLock.Lock()
+	/* snapshots are taken with the machine locked */
+	if ref == nil {
+		var ok bool
+		if ref, ok = m.Snapshots[name]; !ok {
+			m.RegistersLock.Unlock()
+			apiFail(w, http.StatusNotFound, errors.New(fmt.Sprintf("no snapshot is called \"%s\"", name)))
+			return
+		}
+	}
+	ranges, err := m.ParseRanges(args)
+	if err == nil {
+		for _, v := range m.DiffImage(ref, ranges) {
+			ret = append(ret, apiChange{v.Addr, m.AddrName(v.Addr), v.Old, v.New})
+		}
+	}
+	m.RegistersLock.Unlock()
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiWrite(w, http.StatusOK, map[string]interface{}{"changes": ret})
+}
+
+func (a *APIServer) handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+	m := a.Mic
+	if r.Method != "GET" {
+		var req apiBreakpoints
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		m.RegistersLock.Lock()
+		for _, v := range req.PC {
+			if r.Method == "POST" {
+				m.AddPCBR(v)
+			} else {
+				m.RemovePCBR(v)
+			}
+		}
+		for _, v := range req.MPC {
+			if v >= 0 && v < len(m.MCC) {
+				m.SetMCBreak(v, r.Method == "POST")
+			}
+		}
+		m.RegistersLock.Unlock()
+	}
+	m.RegistersLock.Lock()
+	ret := apiBreakpoints{PC: append([]uint16{}, m.PCBR...), MPC: make([]int, 0)}
+	for i, v := range m.MCC {
+		if v != nil && v.BR {
+			ret.MPC = append(ret.MPC, i)
+		}
+	}
+	m.RegistersLock.Unlock()
+	apiWrite(w, http.StatusOK, ret)
+}
+
+func (a *APIServer) handleInput(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "POST") {
+		return
+	}
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	/* queue all of the text or none of it */
+	n := utf8.RuneCountInString(req.Text)
+	if free := cap(a.Mic.Input) - len(a.Mic.Input); n > free {
+		apiFail(w, http.StatusServiceUnavailable, errors.New(fmt.Sprintf("serial input buffer has room for %d characters, not %d", free, n)))
+		return
+	}
+	queued := 0
+	for _, v := range req.Text {
+		select {
+		case a.Mic.Input <- string(v):
+			queued++
+			continue
+		default:
+		}
+		/* another request filled the buffer first */
+		break
+	}
+	apiWrite(w, http.StatusOK, map[string]int{"queued": queued})
+}
+
+func (a *APIServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, "GET") {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiFail(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	c := make(chan apiEvent, 100)
+	a.lock.Lock()
+	a.subs[c] = true
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		delete(a.subs, c)
+		a.lock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	/* start every stream with the current state */
+	c <- apiEvent{"state", a.state()}
+	for {
+		select {
+		case ev := <-c:
+			data, err := json.Marshal(ev.Data)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * Changes records the registers, MAR, MBR and memory words written since it
+ * was last cleared along with the values they had before. The TUI clears it
+ * at each step or run and highlights what is different afterwards.
+ */
+
+/* Change indexes of MAR and MBR after the registers */
+const (
+	CHANGE_MAR = 16
+	CHANGE_MBR = 17
+)
+
+/* Colour of changed registers and memory words */
+const MARK_CHANGED = "\x1b[33m"
+
+type Changes struct {
+	/* Old values of registers, MAR and MBR by change index */
+	Regs map[int]uint16
+	/* Old values of memory words by address */
+	Mem map[uint16]uint16
+}
+
+func NewChanges() *Changes {
+	c := &Changes{}
+	c.Clear()
+	return c
+}
+
+func (c *Changes) Clear() {
+	c.Regs = make(map[int]uint16)
+	c.Mem = make(map[uint16]uint16)
+}
+
+/* Records a register's value before its first write */
+func (c *Changes) reg(i int, old uint16) {
+	if _, ok := c.Regs[i]; !ok {
+		c.Regs[i] = old
+	}
+}
+
+/* Records a memory word's value before its first write */
+func (c *Changes) mem(addr uint16, old uint16) {
+	if _, ok := c.Mem[addr]; !ok {
+		c.Mem[addr] = old
+	}
+}
+
+/* Starts a new set of changes, the machine must not be locked */
+func (m *mic1) ClearChanges() {
+	if m.Changes == nil {
+		return
+	}
+	m.RegistersLock.Lock()
+	m.Changes.Clear()
+	m.RegistersLock.Unlock()
+}
+
+/* Returns the value of a register, MAR or MBR by change index */
+func (m *mic1) changeReg(i int) uint16 {
+	switch i {
+	case CHANGE_MAR:
+		return m.MAR
+	case CHANGE_MBR:
+		return m.MBR
+	}
+	return m.Registers[i]
+}
+
+func changeRegName(i int) string {
+	switch i {
+	case CHANGE_MAR:
+		return "MAR"
+	case CHANGE_MBR:
+		return "MBR"
+	}
+	return RegIdToNames[i]
+}
+
+/* Reports whether a register, MAR or MBR is different from before the changes started */
+func (m *mic1) RegChanged(i int) bool {
+	if m.Changes == nil {
+		return false
+	}
+	old, ok := m.Changes.Regs[i]
+	return ok && old != m.changeReg(i)
+}
+
+/* Reports whether a memory word is different from before the changes started */
+func (m *mic1) MemChanged(addr uint16) bool {
+	if m.Changes == nil {
+		return false
+	}
+	old, ok := m.Changes.Mem[addr]
+	return ok && old != m.Memory[addr]
+}
+
+/* Describes the registers then memory words that changed as old -> new, the machine must be locked */
+func (m *mic1) ChangeLines() []string {
+	ret := make([]string, 0)
+	if m.Changes == nil {
+		return ret
+	}
+	for i := 0; i <= CHANGE_MBR; i++ {
+		if m.RegChanged(i) {
+			old := m.Changes.Regs[i]
+			cur := m.changeReg(i)
+			ret = append(ret, fmt.Sprintf("%-7s: 0x%04x -> 0x%04x  (%d -> %d)", changeRegName(i), old, cur, int16(old), int16(cur)))
+		}
+	}
+	addrs := make([]int, 0, len(m.Changes.Mem))
+	for a := range m.Changes.Mem {
+		if m.MemChanged(a) {
+			addrs = append(addrs, int(a))
+		}
+	}
+	sort.Ints(addrs)
+	for _, a := range addrs {
+		ret = append(ret, m.ChangeString(MemChange{uint16(a), m.Changes.Mem[uint16(a)], m.Memory[a]}))
+	}
+	return ret
+}
+
+/* The changes frame covers the symbols frame while it is shown */
+func (u *TUI) UpdateChangesView(g *gocui.Gui) error {
+	v, err := g.View("changes")
+	if err != nil {
+		return nil
+	}
+	u.Mic.RegistersLock.Lock()
+	lines := u.Mic.ChangeLines()
+	u.Mic.RegistersLock.Unlock()
+	v.Clear()
+	v.Title = fmt.Sprintf("changes - %d", len(lines))
+	for _, l := range lines {
+		fmt.Fprintln(v, l)
+	}
+	return nil
+}
+
+func (u *TUI) ChangesToggle(g *gocui.Gui, v *gocui.View) error {
+	u.ShowChanges = !u.ShowChanges
+	return nil
+}
+
+/* Wraps text in the changed colour when changed is set */
+func markChanged(s string, changed bool) string {
+	if changed {
+		return MARK_CHANGED + s + MARK_END
+	}
+	return s
+}
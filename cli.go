@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -8,6 +9,22 @@ import (
 
 type CLI struct {
 	Mic *mic1
+	/* Number of constant register writes already reported */
+	ViolationsSeen uint64
+	/* Microcode and memory reload functions */
+	MR  func(m *mic1) error
+	MCR func(m *mic1) error
+	/* Breakpoints and watchpoints in the order they were created */
+	Breaks  []CLIBreak
+	NextBrk int
+	/* Expressions shown after every stop, see watch.go */
+	Displays    []CLIDisplay
+	NextDisplay int
+	/* Last x command so a bare x continues from it */
+	LastX     string
+	LastXAddr int
+	/* Lines read from stdin, nil once it is closed */
+	lines chan string
 }
 
 /* Reads a line from stdin and returns it with a newline on the end */
@@ -24,7 +41,8 @@ func ReadStdin(out chan<- string) {
 	}
 }
 
-func (c *CLI) Run() {
+/* The original single letter interface */
+func (c *CLI) RunCompat() {
 	var input rune
 	var addr int16
 	stdin := make(chan string)
@@ -43,17 +61,14 @@ func (c *CLI) Run() {
 		switch input {
 		case 'c':
 			/* continue running until next breakpoint */
-			c.Mic.DesiredState = RUN
-			go c.Mic.Run()
+			finished, _ := c.Mic.Start(context.Background(), nil)
 			wait := true
 			for wait {
 				select {
 				case output := <-c.Mic.Output:
 					fmt.Print(output)
-				case newState := <-c.Mic.StateChanges:
-					if newState == HALT {
-						wait = false
-					}
+				case <-finished:
+					wait = false
 				case in := <-stdin:
 					for _, v := range in {
 						c.Mic.Input <- string(v)
@@ -132,4 +147,20 @@ func (c *CLI) DisplayState() {
 	fmt.Printf("\n")
 	fmt.Printf("%6s : %d\n", "MPC", c.Mic.MPC)
 	fmt.Printf("%6s : %d\n", "Cycles", c.Mic.Cycles)
+	if c.Mic.Fault != nil {
+		fmt.Printf("Error: %s\n", c.Mic.Fault)
+	}
+	c.reportViolations()
+}
+
+/* Prints the constant register writes made since the last report */
+func (c *CLI) reportViolations() {
+	vs, dropped := c.Mic.ConstViolationsSince(c.ViolationsSeen)
+	if dropped > 0 {
+		fmt.Printf("%d earlier writes to constant registers not shown\n", dropped)
+	}
+	for _, v := range vs {
+		fmt.Printf("Write to constant register %s (%d) at MPC %d, cycle %d\n", RegIdToNames[v.Reg], v.Val, v.MPC, v.Cycle)
+	}
+	c.ViolationsSeen = c.Mic.ConstViolationCount
 }
@@ -0,0 +1,1008 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* A gdb style command language for the CLI */
+
+const (
+	BRK_PC = iota
+	BRK_MPC
+	BRK_WATCH
+)
+
+type CLIBreak struct {
+	Num  int
+	Kind int
+	Addr uint16
+	/* Last value seen at a watchpoint */
+	Old uint16
+}
+
+type CLIDisplay struct {
+	Num   int
+	Watch *Watch
+}
+
+type cliCommand struct {
+	Names []string
+	Args  string
+	Help  string
+	Run   func(c *CLI, args string) error
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{[]string{"help", "h"}, "[command]", "Lists the commands or describes one", (*CLI).cmdHelp},
+		{[]string{"step", "s"}, "[n]", "Executes n macro instructions, stopping at breakpoints", (*CLI).cmdStep},
+		{[]string{"next", "n"}, "[n]", "Executes n macro instructions, running each CALL until it returns", (*CLI).cmdNext},
+		{[]string{"finish", "fin"}, "", "Runs until the current routine returns", (*CLI).cmdFinish},
+		{[]string{"advance"}, "location", "Runs until the macro instruction at location is fetched", (*CLI).cmdAdvance},
+		{[]string{"stepi", "si"}, "[n]", "Executes n microinstructions", (*CLI).cmdStepi},
+		{[]string{"stepline", "sl"}, "[n]", "Runs until the PC reaches a different source line n times, stepping into calls", (*CLI).cmdStepLine},
+		{[]string{"continue", "c"}, "", "Runs until a HALT, breakpoint or watchpoint", (*CLI).cmdContinue},
+		{[]string{"break", "b"}, "location", "Stops before the macro instruction at location is fetched", (*CLI).cmdBreak},
+		{[]string{"mbreak", "mb"}, "mpc|label", "Stops before the microinstruction at mpc or a microcode label", (*CLI).cmdMBreak},
+		{[]string{"watch"}, "location", "Stops after the memory word at location is written", (*CLI).cmdWatch},
+		{[]string{"delete", "d"}, "[n...]", "Deletes the numbered breakpoints and watchpoints, or all of them", (*CLI).cmdDelete},
+		{[]string{"info", "i"}, "breakpoints|registers|symbols|snapshots|display", "Lists breakpoints, registers, symbols, snapshots or display expressions", (*CLI).cmdInfo},
+		{[]string{"x"}, "[/nf] [location]", "Examines n memory words in format f (x, d, u, b, c or i)", (*CLI).cmdExamine},
+		{[]string{"print", "p"}, "[/f] expression", "Prints the value of an expression, e.g. AC, mem[SP+1] or count", (*CLI).cmdPrint},
+		{[]string{"display"}, "[/f] [expression|string(address, length)]", "Prints an expression after every stop, or all of them again", (*CLI).cmdDisplay},
+		{[]string{"undisplay"}, "[n...]", "Stops printing the numbered display expressions, or all of them", (*CLI).cmdUndisplay},
+		{[]string{"set"}, "register|mem[address] [=] expression", "Changes a register or memory word", (*CLI).cmdSet},
+		{[]string{"regs"}, "", "Shows the registers", (*CLI).cmdRegs},
+		{[]string{"syms"}, "", "Shows the symbol table", (*CLI).cmdSyms},
+		{[]string{"list", "l"}, "[location]", "Shows the source lines around location or the PC", (*CLI).cmdList},
+		{[]string{"load"}, "[microcode|mc|mcs file] [mem|m|ms file[@base]...]", "Loads a microcode file or memory files at their base addresses, or reloads the current ones", (*CLI).cmdLoad},
+		{[]string{"export"}, "memory|microcode file [format] [range...]", "Writes memory, or only the ranges from..to, or the microcode to a file in any supported format", (*CLI).cmdExport},
+		{[]string{"snapshot"}, "[name]", "Saves a copy of memory called name, or snap, to diff against", (*CLI).cmdSnapshot},
+		{[]string{"diff"}, "[snapshot|file[@base]] [range...]", "Lists the memory words that differ from a snapshot or memory file, by default from memory as it was loaded", (*CLI).cmdDiff},
+		{[]string{"reset"}, "", "Resets the machine and reloads microcode and memory", (*CLI).cmdReset},
+		{[]string{"quit", "q"}, "", "Exits the emulator", nil},
+	}
+}
+
+/* Sends every line read from stdin to out, closing it at the end of input */
+func ReadLines(out chan<- string) {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		out <- s.Text()
+	}
+	close(out)
+}
+
+func (c *CLI) Run() {
+	c.importBreaks()
+	c.Mic.TakeSnapshot(LOADED_SNAPSHOT)
+	c.lines = make(chan string)
+	go ReadLines(c.lines)
+	c.DisplayState()
+	fmt.Println(c.Where())
+	for {
+		if c.lines == nil {
+			return
+		}
+		fmt.Print("(mic1) ")
+		line, ok := <-c.lines
+		if !ok {
+			fmt.Println("")
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name := line
+		args := ""
+		if i := strings.IndexAny(line, " \t/"); i >= 0 {
+			name = line[:i]
+			args = strings.TrimSpace(line[i:])
+		}
+		cmd := findCommand(name)
+		if cmd == nil {
+			fmt.Printf("Unknown command \"%s\", type help for a list of commands\n", name)
+			continue
+		}
+		if cmd.Run == nil {
+			return
+		}
+		if err := cmd.Run(c, args); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+func findCommand(name string) *cliCommand {
+	for i, v := range cliCommands {
+		for _, n := range v.Names {
+			if n == name {
+				return &cliCommands[i]
+			}
+		}
+	}
+	return nil
+}
+
+/* Describes the current macro instruction */
+func (c *CLI) Where() string {
+	m := c.Mic
+	pc := m.CurrentPC()
+	s := fmt.Sprintf("0x%03x <%s>: %s", pc, m.AddrName(pc), m.DisassembleAt(pc))
+	if m.MPC != 0 {
+		s += fmt.Sprintf("  (MPC %d)", m.MPC)
+	}
+	if src := m.SourceString(pc); src != "" {
+		s += "\n" + src
+	}
+	return s
+}
+
+/* Parses an optional count argument */
+func cliCount(args string) (int, error) {
+	if args == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(args)
+	if err != nil || n < 1 {
+		return 0, errors.New(fmt.Sprintf("\"%s\" is not a positive count", args))
+	}
+	return n, nil
+}
+
+/* Evaluates a location and checks that it is inside memory */
+func (c *CLI) location(args string) (uint16, error) {
+	if args == "" {
+		return 0, errors.New("a location is required")
+	}
+	if i := strings.LastIndex(args, ":"); i > 0 {
+		/* file:line from a line map or a symbol file */
+		if line, err := strconv.Atoi(args[i+1:]); err == nil {
+			a, ok := c.Mic.AddrForSource(args[:i], line)
+			if !ok {
+				return 0, errors.New(fmt.Sprintf("no code is at or after %s", args))
+			}
+			return a, nil
+		}
+	}
+	v, err := ParseExpr(args)
+	if err != nil {
+		return 0, err
+	}
+	a, err := v.Eval(c.Mic)
+	if err != nil {
+		return 0, err
+	}
+	if a < 0 || a >= len(c.Mic.Memory) {
+		return 0, errors.New(fmt.Sprintf("address %d is outside of memory", a))
+	}
+	return uint16(a), nil
+}
+
+func (c *CLI) cmdHelp(args string) error {
+	if args != "" {
+		cmd := findCommand(args)
+		if cmd == nil {
+			return errors.New(fmt.Sprintf("Unknown command \"%s\"", args))
+		}
+		fmt.Printf("%s %s\n  %s\n", strings.Join(cmd.Names, ", "), cmd.Args, cmd.Help)
+		return nil
+	}
+	for _, v := range cliCommands {
+		fmt.Printf("%s %s\n    %s\n", v.Names[0], v.Args, v.Help)
+	}
+	fmt.Println("\nLocations and expressions can use numbers, symbols, registers ($name always means a register) and mem[address]")
+	return nil
+}
+
+func (c *CLI) cmdStep(args string) error {
+	n, err := cliCount(args)
+	if err != nil {
+		return err
+	}
+	count := 0
+	c.RunUntil(func(m *mic1) bool {
+		count++
+		return count >= n
+	})
+	return nil
+}
+
+func (c *CLI) cmdNext(args string) error {
+	n, err := cliCount(args)
+	if err != nil {
+		return err
+	}
+	count := 0
+	over := c.Mic.StepOverCond()
+	c.RunUntil(func(m *mic1) bool {
+		if !over(m) {
+			return false
+		}
+		count++
+		over = m.StepOverCond()
+		return count >= n
+	})
+	return nil
+}
+
+func (c *CLI) cmdFinish(args string) error {
+	c.RunUntil(c.Mic.StepOutCond())
+	return nil
+}
+
+func (c *CLI) cmdAdvance(args string) error {
+	a, err := c.location(args)
+	if err != nil {
+		return err
+	}
+	c.RunUntil(c.Mic.RunToCond(a))
+	return nil
+}
+
+func (c *CLI) cmdStepi(args string) error {
+	n, err := cliCount(args)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := c.Mic.Step(); err != nil {
+			return err
+		}
+		c.flushOutput()
+	}
+	m := c.Mic
+	if m.MCC[m.MPC] != nil {
+		fmt.Printf("MPC %d: %s\n", m.MPC, m.MCC[m.MPC].LabelString())
+	}
+	fmt.Println(c.Where())
+	c.showDisplays()
+	return nil
+}
+
+func (c *CLI) cmdStepLine(args string) error {
+	n, err := cliCount(args)
+	if err != nil {
+		return err
+	}
+	if !c.Mic.HasSource() {
+		return errors.New("no line map is loaded, use step")
+	}
+	count := 0
+	line := c.Mic.StepLineCond()
+	c.RunUntil(func(m *mic1) bool {
+		if !line(m) {
+			return false
+		}
+		count++
+		line = m.StepLineCond()
+		return count >= n
+	})
+	return nil
+}
+
+func (c *CLI) cmdContinue(args string) error {
+	c.RunUntil(nil)
+	return nil
+}
+
+/*
+ * Runs the machine, passing serial IO through, until it halts or done returns
+ * true at a macro instruction fetch, then reports why it stopped.
+ */
+func (c *CLI) RunUntil(done func(m *mic1) bool) {
+	m := c.Mic
+	cycles := m.Cycles
+	finished, err := m.Start(context.Background(), done)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	/* a serial backend owns the serial port, otherwise it is the terminal */
+	output, lines := m.Output, c.lines
+	if m.SerialExternal {
+		output, lines = nil, nil
+	}
+	/* typed characters waiting for room in the serial input channel */
+	pending := ""
+	wait := true
+	for wait {
+		var input chan string
+		next := ""
+		if pending != "" {
+			input = m.Input
+			next = pending[:1]
+		}
+		select {
+		case output := <-output:
+			fmt.Print(output)
+		case <-finished:
+			wait = false
+		case input <- next:
+			pending = pending[1:]
+		case in, ok := <-lines:
+			if !ok {
+				m.Halt()
+				c.lines, lines = nil, nil
+				continue
+			}
+			pending += in + "\n"
+		}
+	}
+	c.flushOutput()
+	c.reportStop(cycles)
+}
+
+func (c *CLI) flushOutput() {
+	if c.Mic.SerialExternal {
+		return
+	}
+	for {
+		select {
+		case output := <-c.Mic.Output:
+			fmt.Print(output)
+		default:
+			return
+		}
+	}
+}
+
+/* Explains why the machine stopped after starting at the given cycle */
+func (c *CLI) reportStop(start uint64) {
+	m := c.Mic
+	for i := range c.Breaks {
+		b := &c.Breaks[i]
+		switch b.Kind {
+		case BRK_PC:
+			if m.MPC == 0 && m.Registers[REG_PC] == b.Addr {
+				fmt.Printf("Breakpoint %d, ", b.Num)
+			}
+		case BRK_MPC:
+			if uint16(m.MPC) == b.Addr && m.Cycles != start {
+				fmt.Printf("Microcode breakpoint %d, ", b.Num)
+			}
+		case BRK_WATCH:
+			if m.LastWrite == b.Addr && m.LastWriteCycle+1 == m.Cycles && m.Cycles != start {
+				fmt.Printf("Watchpoint %d: mem[%s] %d -> %d\n", b.Num, m.AddrName(b.Addr), int16(b.Old), int16(m.Memory[b.Addr]))
+			}
+			b.Old = m.Memory[b.Addr]
+		}
+	}
+	if m.Fault != nil {
+		fmt.Printf("Error: %s, ", m.Fault)
+	} else if m.MPC == 0 && m.Registers[REG_IR]&0xFF00 == MACRO_HALT {
+		fmt.Print("Program halted, ")
+	}
+	fmt.Println(c.Where())
+	c.reportViolations()
+	c.showDisplays()
+}
+
+/* Numbers breakpoints and watchpoints that were set before the CLI started */
+func (c *CLI) importBreaks() {
+	m := c.Mic
+	for _, v := range m.PCBR {
+		c.addBreak(BRK_PC, v)
+	}
+	for i, v := range m.MCC {
+		if v != nil && v.BR {
+			c.addBreak(BRK_MPC, uint16(i))
+		}
+	}
+	for _, v := range m.MemWatch {
+		c.addBreak(BRK_WATCH, v)
+	}
+}
+
+func (c *CLI) addBreak(kind int, addr uint16) *CLIBreak {
+	for i, b := range c.Breaks {
+		if b.Kind == kind && b.Addr == addr {
+			return &c.Breaks[i]
+		}
+	}
+	c.NextBrk++
+	c.Breaks = append(c.Breaks, CLIBreak{Num: c.NextBrk, Kind: kind, Addr: addr, Old: c.Mic.Memory[addr&0x0FFF]})
+	return &c.Breaks[len(c.Breaks)-1]
+}
+
+func (c *CLI) cmdBreak(args string) error {
+	a, err := c.location(args)
+	if err != nil {
+		return err
+	}
+	if sym, ok := c.Mic.SymbolAt(a); ok && sym.Kind == SYM_DATA {
+		fmt.Printf("Warning: %s is data\n", sym.Name)
+	}
+	c.Mic.AddPCBR(a)
+	b := c.addBreak(BRK_PC, a)
+	if loc, ok := c.Mic.SourceFor(a); ok {
+		fmt.Printf("Breakpoint %d at 0x%03x <%s>: %s\n", b.Num, a, c.Mic.AddrName(a), loc)
+	} else {
+		fmt.Printf("Breakpoint %d at 0x%03x <%s>\n", b.Num, a, c.Mic.AddrName(a))
+	}
+	return nil
+}
+
+func (c *CLI) cmdMBreak(args string) error {
+	v, err := c.Mic.MCSlot(args)
+	if err != nil {
+		return err
+	}
+	if v >= len(c.Mic.MCC) || c.Mic.MCC[v] == nil {
+		return errors.New(fmt.Sprintf("there is no microinstruction at %d", v))
+	}
+	c.Mic.SetMCBreak(v, true)
+	b := c.addBreak(BRK_MPC, uint16(v))
+	fmt.Printf("Microcode breakpoint %d at MPC %d: %s\n", b.Num, v, c.Mic.MCC[v].LabelString())
+	return nil
+}
+
+func (c *CLI) cmdWatch(args string) error {
+	a, err := c.location(args)
+	if err != nil {
+		return err
+	}
+	c.Mic.AddWatch(a)
+	b := c.addBreak(BRK_WATCH, a)
+	fmt.Printf("Watchpoint %d: mem[%s]\n", b.Num, c.Mic.AddrName(a))
+	return nil
+}
+
+func (c *CLI) removeBreak(b CLIBreak) {
+	switch b.Kind {
+	case BRK_PC:
+		c.Mic.RemovePCBR(b.Addr)
+	case BRK_MPC:
+		c.Mic.SetMCBreak(int(b.Addr), false)
+	case BRK_WATCH:
+		c.Mic.RemoveWatch(b.Addr)
+	}
+}
+
+func (c *CLI) cmdDelete(args string) error {
+	if args == "" {
+		for _, b := range c.Breaks {
+			c.removeBreak(b)
+		}
+		c.Breaks = nil
+		return nil
+	}
+	for _, f := range strings.Fields(args) {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return errors.New(fmt.Sprintf("\"%s\" is not a breakpoint number", f))
+		}
+		found := false
+		for i, b := range c.Breaks {
+			if b.Num == n {
+				c.removeBreak(b)
+				c.Breaks = append(c.Breaks[:i], c.Breaks[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("No breakpoint number %d", n))
+		}
+	}
+	return nil
+}
+
+func (c *CLI) cmdInfo(args string) error {
+	switch {
+	case args != "" && strings.HasPrefix("breakpoints", args), args != "" && strings.HasPrefix("watchpoints", args):
+		if len(c.Breaks) == 0 {
+			fmt.Println("No breakpoints or watchpoints")
+		}
+		for _, b := range c.Breaks {
+			switch b.Kind {
+			case BRK_PC:
+				if loc, ok := c.Mic.SourceFor(b.Addr); ok {
+					fmt.Printf("%-3d breakpoint  0x%03x <%s> at %s\n", b.Num, b.Addr, c.Mic.AddrName(b.Addr), loc)
+				} else {
+					fmt.Printf("%-3d breakpoint  0x%03x <%s>\n", b.Num, b.Addr, c.Mic.AddrName(b.Addr))
+				}
+			case BRK_MPC:
+				if ins := c.Mic.MCC[b.Addr]; ins != nil && ins.Label != "" {
+					fmt.Printf("%-3d mbreakpoint MPC %d <%s>\n", b.Num, b.Addr, ins.Label)
+				} else {
+					fmt.Printf("%-3d mbreakpoint MPC %d\n", b.Num, b.Addr)
+				}
+			case BRK_WATCH:
+				fmt.Printf("%-3d watchpoint  mem[%s]\n", b.Num, c.Mic.AddrName(b.Addr))
+			}
+		}
+	case args != "" && strings.HasPrefix("registers", args):
+		c.DisplayState()
+	case args != "" && strings.HasPrefix("symbols", args):
+		return c.cmdSyms("")
+	case args != "" && strings.HasPrefix("display", args):
+		if len(c.Displays) == 0 {
+			fmt.Println("No display expressions")
+		}
+		for _, d := range c.Displays {
+			fmt.Printf("%-3d %s\n", d.Num, d.Watch)
+		}
+	case args != "" && strings.HasPrefix("snapshots", args):
+		names := make([]string, 0, len(c.Mic.Snapshots))
+		for n := range c.Mic.Snapshots {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Println(strings.Join(names, " "))
+	default:
+		return errors.New("info breakpoints, info registers, info symbols, info snapshots or info display")
+	}
+	return nil
+}
+
+/* Formats a word in one of the x and print formats */
+/* Splits "/nf rest" into a count, format and the rest */
+func cliFormat(args string, count int, f byte) (int, byte, string, error) {
+	if !strings.HasPrefix(args, "/") {
+		return count, f, args, nil
+	}
+	spec := args[1:]
+	rest := ""
+	if i := strings.IndexAny(spec, " \t"); i >= 0 {
+		rest = strings.TrimSpace(spec[i:])
+		spec = spec[:i]
+	}
+	digits := strings.TrimRightFunc(spec, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if digits != "" {
+		n, err := strconv.Atoi(digits)
+		if err != nil || n < 1 {
+			return 0, 0, "", errors.New(fmt.Sprintf("bad count in \"/%s\"", spec))
+		}
+		count = n
+	}
+	if fs := spec[len(digits):]; fs != "" {
+		if len(fs) != 1 || !strings.Contains("xdubci", fs) {
+			return 0, 0, "", errors.New(fmt.Sprintf("unknown format \"%s\", use x, d, u, b, c or i", fs))
+		}
+		f = fs[0]
+	}
+	return count, f, rest, nil
+}
+
+func (c *CLI) cmdExamine(args string) error {
+	count, f, rest, err := cliFormat(args, 1, 'x')
+	if err != nil {
+		return err
+	}
+	if args == "" && c.LastX != "" {
+		count, f, _, _ = cliFormat(c.LastX, 1, 'x')
+	}
+	addr := c.LastXAddr
+	if rest != "" {
+		a, err := c.location(rest)
+		if err != nil {
+			return err
+		}
+		addr = int(a)
+	}
+	m := c.Mic
+	perLine := 8
+	if f == 'i' || f == 'b' {
+		perLine = 1
+	}
+	for i := 0; i < count && addr < len(m.Memory); i++ {
+		if i%perLine == 0 {
+			if i != 0 {
+				fmt.Print("\n")
+			}
+			fmt.Printf("0x%03x <%s>:", addr, m.AddrName(uint16(addr)))
+		}
+		if f == 'i' {
+			fmt.Printf(" %s", m.DisassembleAt(uint16(addr)))
+			if loc, ok := m.SourceFor(uint16(addr)); ok {
+				fmt.Printf("  ; %s", loc)
+			}
+		} else {
+			fmt.Printf(" %s", c.Mic.FormatWord(m.Memory[addr], f))
+		}
+		addr++
+	}
+	fmt.Print("\n")
+	c.LastX = fmt.Sprintf("/%d%c", count, f)
+	c.LastXAddr = addr
+	return nil
+}
+
+func (c *CLI) cmdPrint(args string) error {
+	_, f, rest, err := cliFormat(args, 1, 0)
+	if err != nil {
+		return err
+	}
+	v, err := c.Mic.Eval(rest)
+	if err != nil {
+		return err
+	}
+	if f == 0 {
+		fmt.Printf("%s = %d (0x%04x)\n", rest, int16(v), v)
+	} else {
+		fmt.Printf("%s = %s\n", rest, c.Mic.FormatWord(v, f))
+	}
+	return nil
+}
+
+func (c *CLI) cmdSet(args string) error {
+	target := args
+	value := ""
+	if i := strings.Index(args, "="); i >= 0 {
+		target = strings.TrimSpace(args[:i])
+		value = args[i+1:]
+	} else if i := strings.LastIndexAny(args, " \t"); i >= 0 {
+		target = strings.TrimSpace(args[:i])
+		value = args[i+1:]
+	}
+	if target == "" || strings.TrimSpace(value) == "" {
+		return errors.New("usage: set register|mem[address] [=] expression")
+	}
+	v, err := c.Mic.Eval(value)
+	if err != nil {
+		return err
+	}
+	m := c.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	if strings.HasPrefix(target, "mem[") && strings.HasSuffix(target, "]") {
+		a, err := c.location(target[4 : len(target)-1])
+		if err != nil {
+			return err
+		}
+		m.Memory[a] = v
+		return nil
+	}
+	if m.SetRegister(strings.TrimPrefix(target, "$"), v) {
+		return nil
+	}
+	if _, ok := m.LookupSymbol(target); ok {
+		return errors.New(fmt.Sprintf("\"%s\" is a symbol, use set mem[%s] to change the word it labels", target, target))
+	}
+	return errors.New(fmt.Sprintf("unknown register \"%s\"", target))
+}
+
+func (c *CLI) cmdRegs(args string) error {
+	c.DisplayState()
+	return nil
+}
+
+func (c *CLI) cmdSyms(args string) error {
+	if len(c.Mic.MemSymbols) == 0 {
+		fmt.Println("No symbols loaded")
+	}
+	for _, v := range c.Mic.MemSymbols {
+		if info := v.Info(); info != "" {
+			fmt.Printf("%-24s : %-5d (%s)\n", v.Name, v.Val, info)
+		} else {
+			fmt.Printf("%-24s : %d\n", v.Name, v.Val)
+		}
+	}
+	return nil
+}
+
+/* Shows the source around a location, > marks the PC's line and * lines with breakpoints */
+func (c *CLI) cmdList(args string) error {
+	m := c.Mic
+	if !m.HasSource() {
+		return errors.New("no line map is loaded")
+	}
+	addr := m.CurrentPC()
+	if args != "" {
+		a, err := c.location(args)
+		if err != nil {
+			return err
+		}
+		addr = a
+	}
+	loc, ok := m.SourceFor(addr)
+	if !ok {
+		return errors.New(fmt.Sprintf("0x%03x <%s> has no source line", addr, m.AddrName(addr)))
+	}
+	lines := m.SourceLines(loc.File)
+	if len(lines) == 0 {
+		return errors.New(fmt.Sprintf("can't read %s", loc.File))
+	}
+	pc, _ := m.SourceFor(m.CurrentPC())
+	brk := m.SourceBreaks(loc.File)
+	for i := loc.Line - 5; i <= loc.Line+5; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		cur, br := ' ', ' '
+		if pc.File == loc.File && pc.Line == i {
+			cur = '>'
+		}
+		if brk[i] {
+			br = '*'
+		}
+		fmt.Printf("%c%c%4d  %s\n", cur, br, i, lines[i-1])
+	}
+	return nil
+}
+
+func (c *CLI) cmdLoad(args string) error {
+	f := strings.Fields(args)
+	if len(f) == 0 {
+		return c.reload()
+	}
+	if len(f) < 2 {
+		return errors.New("usage: load [microcode|mc|mcs file] [mem|m|ms file[@base]...]")
+	}
+	fname := f[1]
+	m := c.Mic
+	switch f[0] {
+	case "microcode", "mc", "mcs":
+		if len(f) != 2 {
+			return errors.New("only one microcode file can be loaded")
+		}
+		format := f[0]
+		if format == "microcode" {
+			format = "auto"
+		}
+		mcr := func(m *mic1) error {
+			img, err := LoadMCFile(fname, format)
+			if err != nil {
+				return err
+			}
+			m.LoadMCImage(img)
+			return nil
+		}
+		/* decode it before clearing the control store */
+		img, err := LoadMCFile(fname, format)
+		if err != nil {
+			return err
+		}
+		m.Reload(func(m *mic1) error {
+			m.ZeroMC()
+			m.LoadMCImage(img)
+			return nil
+		})
+		c.MCR = mcr
+	case "mem", "m", "ms":
+		format := f[0]
+		if format == "mem" {
+			format = "auto"
+		}
+		files := make([]MemFile, 0)
+		for _, v := range f[1:] {
+			mf, err := ParseMemFile(v, format)
+			if err != nil {
+				return err
+			}
+			files = append(files, mf)
+		}
+		mr := func(m *mic1) error {
+			return LoadMemFiles(m, files)
+		}
+		err := m.Reload(func(m *mic1) error {
+			if err := m.ReplaceMem(files); err != nil {
+				return err
+			}
+			m.TakeSnapshot(LOADED_SNAPSHOT)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		c.MR = mr
+		fname = strings.Join(f[1:], " ")
+	default:
+		return errors.New(fmt.Sprintf("unknown file type \"%s\", use microcode, mc, mcs, mem, m or ms", f[0]))
+	}
+	fmt.Println("Loaded", fname)
+	return nil
+}
+
+/* Reloads the microcode and memory files */
+func (c *CLI) reload() error {
+	return c.Mic.Reload(c.loadFiles)
+}
+
+/* Loads the microcode and memory files again, the machine must be locked */
+func (c *CLI) loadFiles(m *mic1) error {
+	if c.MCR != nil {
+		m.ZeroMC()
+		if err := c.MCR(m); err != nil {
+			return err
+		}
+	}
+	if c.MR != nil {
+		m.ZeroMem()
+		if err := c.MR(m); err != nil {
+			return err
+		}
+		m.TakeSnapshot(LOADED_SNAPSHOT)
+	}
+	/* reloading the microcode drops microcode breakpoints */
+	for _, b := range c.Breaks {
+		if b.Kind == BRK_MPC {
+			m.SetMCBreak(int(b.Addr), true)
+		}
+	}
+	return nil
+}
+
+func (c *CLI) cmdExport(args string) error {
+	f := strings.Fields(args)
+	if len(f) < 2 {
+		return errors.New("usage: export memory|microcode file [format] [range...]")
+	}
+	m := c.Mic
+	fname, rest := f[1], f[2:]
+	switch f[0] {
+	case "memory", "mem":
+		format := ""
+		if len(rest) > 0 && FindMemDecoder(rest[0]) != nil {
+			format, rest = rest[0], rest[1:]
+		}
+		ranges, err := m.ParseRanges(rest)
+		if err != nil {
+			return err
+		}
+		img := m.MemImageOf(ranges)
+		enc, err := SaveMemFile(fname, format, img)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d words in %d segments to %s as %s\n", img.Len(), len(img.Segments), fname, enc.Desc)
+	case "microcode", "mc":
+		format := ""
+		if len(rest) > 0 {
+			format, rest = rest[0], rest[1:]
+		}
+		if len(rest) > 0 {
+			return errors.New("microcode is always written from slot 0, it can't be limited to ranges")
+		}
+		img := m.MCImageOf()
+		enc, err := SaveMCFile(fname, format, img)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d microcode words to %s as %s\n", len(img.Words), fname, enc.Desc)
+	default:
+		return errors.New(fmt.Sprintf("unknown image \"%s\", use memory or microcode", f[0]))
+	}
+	return nil
+}
+
+func (c *CLI) cmdSnapshot(args string) error {
+	name := args
+	if name == "" {
+		name = "snap"
+	}
+	if strings.ContainsAny(name, " \t") {
+		return errors.New("snapshot names can't contain spaces")
+	}
+	c.Mic.TakeSnapshot(name)
+	fmt.Printf("Saved memory as %s\n", name)
+	return nil
+}
+
+func (c *CLI) cmdDiff(args string) error {
+	m := c.Mic
+	f := strings.Fields(args)
+	name := LOADED_SNAPSHOT
+	if len(f) > 0 {
+		/* the first argument is a snapshot or file unless it is a range */
+		if _, err := m.MemReference(f[0]); err == nil {
+			name, f = f[0], f[1:]
+		} else if _, rerr := m.ParseRange(f[0]); rerr != nil {
+			return err
+		}
+	}
+	ref, err := m.MemReference(name)
+	if err != nil {
+		return err
+	}
+	ranges, err := m.ParseRanges(f)
+	if err != nil {
+		return err
+	}
+	changes := m.DiffImage(ref, ranges)
+	for _, v := range changes {
+		fmt.Println(m.ChangeString(v))
+	}
+	if len(changes) == 1 {
+		fmt.Printf("1 word differs from %s\n", name)
+	} else {
+		fmt.Printf("%d words differ from %s\n", len(changes), name)
+	}
+	return nil
+}
+
+func (c *CLI) cmdReset(args string) error {
+	err := c.Mic.Reload(func(m *mic1) error {
+		m.resetRegisters()
+		return c.loadFiles(m)
+	})
+	/* the reset cleared the machine's constant register writes */
+	c.ViolationsSeen = 0
+	if err != nil {
+		return err
+	}
+	fmt.Println(c.Where())
+	c.showDisplays()
+	return nil
+}
+
+func (c *CLI) cmdDisplay(args string) error {
+	if args == "" {
+		c.showDisplays()
+		return nil
+	}
+	w, err := ParseWatch(args)
+	if err != nil {
+		return err
+	}
+	c.NextDisplay++
+	c.Displays = append(c.Displays, CLIDisplay{c.NextDisplay, w})
+	c.showDisplay(c.Displays[len(c.Displays)-1])
+	return nil
+}
+
+func (c *CLI) cmdUndisplay(args string) error {
+	if args == "" {
+		c.Displays = nil
+		return nil
+	}
+	for _, f := range strings.Fields(args) {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return errors.New(fmt.Sprintf("\"%s\" is not a display number", f))
+		}
+		found := false
+		for i, d := range c.Displays {
+			if d.Num == n {
+				c.Displays = append(c.Displays[:i], c.Displays[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("No display number %d", n))
+		}
+	}
+	return nil
+}
+
+func (c *CLI) showDisplay(d CLIDisplay) {
+	c.Mic.RegistersLock.Lock()
+	defer c.Mic.RegistersLock.Unlock()
+	fmt.Printf("%d: %s = %s\n", d.Num, d.Watch, d.Watch.Value(c.Mic))
+}
+
+func (c *CLI) showDisplays() {
+	for _, d := range c.Displays {
+		c.showDisplay(d)
+	}
+}
@@ -0,0 +1,271 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* Project configuration, read from a JSON file. Command line flags win over it. */
+
+const CONFIG_FILE = "mic1.json"
+
+type ConfigFile struct {
+	File string `json:"file"`
+	/*
+	 * A microcode or memory format (see MCDecoders and MemDecoders) or auto.
+	 * When empty the format is detected from the contents, except for memory
+	 * files ending in .m or .ms.
+	 */
+	Format string `json:"format"`
+	/* Memory load address */
+	Base uint16 `json:"base"`
+}
+
+/* A number or an expression such as "fact" or "SP-4" */
+type ConfigValue string
+
+func (v *ConfigValue) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(b, &n); err == nil {
+		*v = ConfigValue(fmt.Sprintf("%d", n))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(fmt.Sprintf("%s is not a number or a string", string(b)))
+	}
+	*v = ConfigValue(s)
+	return nil
+}
+
+type ConfigDevices struct {
+	/* Address of the four serial port words */
+	Serial *uint16 `json:"serial"`
+}
+
+type ConfigUI struct {
+	/* cli, compat or tui */
+	Mode            string `json:"mode"`
+	Keys            string `json:"keys"`
+	MemoryHex       *bool  `json:"memoryHex"`
+	SymbolsHex      *bool  `json:"symbolsHex"`
+	FollowMicrocode *bool  `json:"followMicrocode"`
+	/* none, pc, sp or access */
+	FollowMemory string `json:"followMemory"`
+	/* Cycles per second of animate mode */
+	Clock int `json:"clock"`
+}
+
+type Config struct {
+	Microcode        ConfigFile             `json:"microcode"`
+	Memory           []ConfigFile           `json:"memory"`
+	Symbols          []ConfigFile           `json:"symbols"`
+	Lines            []ConfigFile           `json:"lines"`
+	Registers        map[string]ConfigValue `json:"registers"`
+	Breakpoints      []ConfigValue          `json:"breakpoints"`
+	MicroBreakpoints []ConfigValue          `json:"microBreakpoints"`
+	Watchpoints      []ConfigValue          `json:"watchpoints"`
+	Devices          ConfigDevices          `json:"devices"`
+	/* stdio, null or tcp:address */
+	Serial string   `json:"serial"`
+	UI     ConfigUI `json:"ui"`
+
+	/* Directory relative file names are resolved against */
+	Dir string `json:"-"`
+}
+
+/*
+ * Loads the given config file, or mic1.json from the working directory when
+ * fp is empty. Returns nil without an error when there is no config.
+ */
+func FindConfig(fp string) (*Config, error) {
+	if fp == "" {
+		if _, err := os.Stat(CONFIG_FILE); err != nil {
+			return nil, nil
+		}
+		fp = CONFIG_FILE
+	}
+	log.Println("Reading config file:", fp)
+	buff, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(buff, c); err != nil {
+		return nil, errors.New(fmt.Sprintf("Config file, \"%s\": %s", fp, err.Error()))
+	}
+	c.Dir = filepath.Dir(fp)
+	if err := c.check(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Config file, \"%s\": %s", fp, err.Error()))
+	}
+	return c, nil
+}
+
+func (c *Config) check() error {
+	if c.Microcode.File != "" {
+		if f := c.Microcode.Format; f != "" && f != "auto" && FindMCDecoder(f) == nil {
+			return errors.New(fmt.Sprintf("unknown microcode format \"%s\", use auto, %s", f, MCFormatNames()))
+		}
+	}
+	for _, v := range c.Memory {
+		if f := v.format(); f != "auto" && FindMemDecoder(f) == nil {
+			return errors.New(fmt.Sprintf("unknown memory format \"%s\" for \"%s\", use auto, %s", f, v.File, MemFormatNames()))
+		}
+	}
+	if c.Devices.Serial != nil && *c.Devices.Serial > 4092 {
+		return errors.New(fmt.Sprintf("serial port at %d runs past the end of memory", *c.Devices.Serial))
+	}
+	switch c.UI.Mode {
+	case "", "cli", "compat", "tui":
+	default:
+		return errors.New(fmt.Sprintf("unknown ui mode \"%s\", use cli, compat or tui", c.UI.Mode))
+	}
+	if _, ok := followModes[c.UI.FollowMemory]; !ok {
+		return errors.New(fmt.Sprintf("unknown followMemory \"%s\", use none, pc, sp or access", c.UI.FollowMemory))
+	}
+	return nil
+}
+
+var followModes = map[string]int{"": FOLLOW_NONE, "none": FOLLOW_NONE, "pc": FOLLOW_PC, "sp": FOLLOW_SP, "access": FOLLOW_ACCESS}
+
+/* Resolves a file name relative to the config file */
+func (c *Config) Path(fp string) string {
+	if fp == "" || filepath.IsAbs(fp) {
+		return fp
+	}
+	return filepath.Join(c.Dir, fp)
+}
+
+/* Memory file format */
+func (f ConfigFile) format() string {
+	if f.Format != "" {
+		return f.Format
+	}
+	if ext := strings.TrimPrefix(filepath.Ext(f.File), "."); ext == "m" || ext == "ms" {
+		return ext
+	}
+	return "auto"
+}
+
+func (c *Config) LoadMicrocode(m *mic1) error {
+	fname := c.Path(c.Microcode.File)
+	img, err := LoadMCFile(fname, c.Microcode.Format)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d microcode instructions from %s", len(img.Words), fname)
+	m.LoadMCImage(img)
+	return c.setMicroBreakpoints(m)
+}
+
+func (c *Config) setMicroBreakpoints(m *mic1) error {
+	for _, v := range c.MicroBreakpoints {
+		i, err := m.MCSlot(string(v))
+		if err != nil {
+			return errors.New(fmt.Sprintf("microcode breakpoint %s: %s", v, err.Error()))
+		}
+		if i >= len(m.MCC) || m.MCC[i] == nil {
+			return errors.New(fmt.Sprintf("there is no microinstruction at %s for a breakpoint", v))
+		}
+		m.SetMCBreak(i, true)
+	}
+	return nil
+}
+
+/* Loads every memory file at its base address with the symbol files and line maps, symbols from all of them are kept */
+func (c *Config) LoadMemory(m *mic1) error {
+	files := make([]MemFile, len(c.Memory))
+	for i, v := range c.Memory {
+		files[i] = MemFile{File: c.Path(v.File), Format: v.format(), Base: v.Base}
+	}
+	if err := LoadMemFiles(m, files); err != nil {
+		return err
+	}
+	syms := make([]MemFile, len(c.Symbols))
+	for i, v := range c.Symbols {
+		syms[i] = MemFile{File: c.Path(v.File), Base: v.Base}
+	}
+	if err := LoadSymbolFiles(m, syms); err != nil {
+		return err
+	}
+	lines := make([]MemFile, len(c.Lines))
+	for i, v := range c.Lines {
+		lines[i] = MemFile{File: c.Path(v.File), Base: v.Base}
+	}
+	return LoadLineMaps(m, lines)
+}
+
+/* Sets the initial register values, they can refer to symbols */
+func (c *Config) SetRegisters(m *mic1) error {
+	for name, v := range c.Registers {
+		val, err := m.Eval(string(v))
+		if err != nil {
+			return errors.New(fmt.Sprintf("register %s: %s", name, err.Error()))
+		}
+		if !m.SetRegister(name, val) {
+			return errors.New(fmt.Sprintf("unknown register \"%s\"", name))
+		}
+	}
+	return nil
+}
+
+/* Sets the serial port, breakpoints and watchpoints */
+func (c *Config) Apply(m *mic1) error {
+	if c.Devices.Serial != nil {
+		m.SerialBase = *c.Devices.Serial
+	}
+	if err := c.setMicroBreakpoints(m); err != nil {
+		return err
+	}
+	for _, v := range c.Breakpoints {
+		a, err := m.Eval(string(v))
+		if err != nil {
+			return errors.New(fmt.Sprintf("breakpoint %s: %s", v, err.Error()))
+		}
+		m.AddPCBR(a & 0x0FFF)
+	}
+	for _, v := range c.Watchpoints {
+		a, err := m.Eval(string(v))
+		if err != nil {
+			return errors.New(fmt.Sprintf("watchpoint %s: %s", v, err.Error()))
+		}
+		m.AddWatch(a & 0x0FFF)
+	}
+	return nil
+}
+
+/* Sets the TUI's display preferences */
+func (c *Config) ApplyTUI(u *TUI) {
+	if c.UI.MemoryHex != nil {
+		u.MemHex = *c.UI.MemoryHex
+	}
+	if c.UI.SymbolsHex != nil {
+		u.SymHex = *c.UI.SymbolsHex
+	}
+	if c.UI.FollowMicrocode != nil {
+		u.MCFollow = *c.UI.FollowMicrocode
+	}
+	u.MemFollow = followModes[c.UI.FollowMemory]
+}
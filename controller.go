@@ -0,0 +1,255 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The controller starts, stops, steps and resets the machine. All of its
+ * methods are safe to call from any goroutine: only one run or reload can be
+ * in progress, stepping is refused while one is, and halting never blocks.
+ * Lock order is ctlLock before RegistersLock, so none of these may be called
+ * with the registers locked or from a run's stop condition.
+ */
+
+var ErrRunning = errors.New("the machine is running")
+
+/* Longest a clocked run sleeps before checking for a halt or a new rate */
+const CLOCK_POLL = 20 * time.Millisecond
+
+/* Reports whether a run is in progress */
+func (m *mic1) Running() bool {
+	return atomic.LoadInt32(&m.state) == RUN
+}
+
+/*
+ * Starts a run in a new goroutine that stops when a halt is requested, at a
+ * breakpoint, when ctx is cancelled or at the first macro instruction fetch
+ * where done returns true. done can be nil. The returned channel is closed
+ * once the run has stopped.
+ */
+func (m *mic1) Start(ctx context.Context, done func(m *mic1) bool) (<-chan struct{}, error) {
+	m.ctlLock.Lock()
+	if m.runDone != nil {
+		m.ctlLock.Unlock()
+		return nil, ErrRunning
+	}
+	finished := make(chan struct{})
+	m.runDone = finished
+	m.RegistersLock.Lock()
+	m.Fault = nil
+	m.RegistersLock.Unlock()
+	m.setDesiredState(RUN)
+	atomic.StoreInt32(&m.state, RUN)
+	m.ctlLock.Unlock()
+	m.publishState(RUN)
+
+	go func() {
+		next := time.Now()
+		for m.DesiredState() == RUN && ctx.Err() == nil {
+			rate := m.ClockRate()
+			if rate == 0 {
+				m.runBatch(RUN_BATCH, done)
+				next = time.Now()
+				continue
+			}
+			m.runBatch(1, done)
+			next = next.Add(time.Second / time.Duration(rate))
+			if now := time.Now(); next.Before(now) {
+				/* don't rush to catch up after falling behind */
+				next = now
+			}
+			m.waitTick(ctx, next, rate)
+		}
+		m.ctlLock.Lock()
+		m.setDesiredState(HALT)
+		atomic.StoreInt32(&m.state, HALT)
+		m.runDone = nil
+		close(finished)
+		m.ctlLock.Unlock()
+		m.publishState(HALT)
+	}()
+	return finished, nil
+}
+
+/* Runs until a halt is requested, a breakpoint is hit or ctx is cancelled */
+func (m *mic1) Run(ctx context.Context) error {
+	return m.RunUntil(ctx, nil)
+}
+
+/* Runs like Run but also halts at the first macro instruction fetch where done returns true */
+func (m *mic1) RunUntil(ctx context.Context, done func(m *mic1) bool) error {
+	finished, err := m.Start(ctx, done)
+	if err != nil {
+		return err
+	}
+	<-finished
+	return ctx.Err()
+}
+
+/*
+ * Sets the cycles per second runs are clocked at, 0 runs as fast as
+ * possible. A run in progress changes speed straight away.
+ */
+func (m *mic1) SetClockRate(hz int) {
+	if hz < 0 {
+		hz = 0
+	}
+	atomic.StoreInt32(&m.clockRate, int32(hz))
+}
+
+func (m *mic1) ClockRate() int {
+	return int(atomic.LoadInt32(&m.clockRate))
+}
+
+/* Sleeps until the next clock tick unless the run is halted or its rate changes first */
+func (m *mic1) waitTick(ctx context.Context, next time.Time, rate int) {
+	for m.DesiredState() == RUN && ctx.Err() == nil && m.ClockRate() == rate {
+		d := time.Until(next)
+		if d <= 0 {
+			return
+		}
+		if d > CLOCK_POLL {
+			d = CLOCK_POLL
+		}
+		time.Sleep(d)
+	}
+}
+
+/* Asks the run in progress to stop at the end of its cycle without waiting for it */
+func (m *mic1) Halt() {
+	m.setDesiredState(HALT)
+}
+
+/* Waits for the run in progress, if any, to stop */
+func (m *mic1) Wait() {
+	m.ctlLock.Lock()
+	finished := m.runDone
+	m.ctlLock.Unlock()
+	if finished != nil {
+		<-finished
+	}
+}
+
+/* Executes one microcode cycle */
+func (m *mic1) Step() error {
+	return m.step(1, false)
+}
+
+/* Executes microcode cycles until the next macro instruction fetch at MPC 0, at most limit cycles */
+func (m *mic1) StepInstruction(limit int) error {
+	return m.step(limit, true)
+}
+
+func (m *mic1) step(limit int, toFetch bool) error {
+	m.ctlLock.Lock()
+	defer m.ctlLock.Unlock()
+	if m.runDone != nil {
+		return ErrRunning
+	}
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	m.decodeOps()
+	m.Fault = nil
+	for i := 0; i < limit; i++ {
+		m.cycle()
+		if m.Fault != nil {
+			return m.Fault
+		}
+		if m.BatchInput && m.RCRV&9 == 9 {
+			m.pollInput()
+		}
+		if toFetch && m.MPC == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+/* Stops any run, waiting for it, and puts the registers back to their starting values */
+func (m *mic1) Reset() {
+	m.Reload(func(m *mic1) error {
+		m.resetRegisters()
+		return nil
+	})
+}
+
+/*
+ * Stops any run, waiting for it, and calls load with the machine locked.
+ * Runs and steps get ErrRunning, and Wait and Reset wait, until load returns,
+ * so clearing and reloading microcode or memory can't race them.
+ */
+func (m *mic1) Reload(load func(m *mic1) error) error {
+	m.ctlLock.Lock()
+	for m.runDone != nil {
+		finished := m.runDone
+		m.Halt()
+		m.ctlLock.Unlock()
+		<-finished
+		m.ctlLock.Lock()
+	}
+	/* stands in for a run until the load is done */
+	busy := make(chan struct{})
+	m.runDone = busy
+	m.ctlLock.Unlock()
+
+	m.RegistersLock.Lock()
+	err := load(m)
+	m.RegistersLock.Unlock()
+
+	m.ctlLock.Lock()
+	m.runDone = nil
+	close(busy)
+	m.ctlLock.Unlock()
+	return err
+}
+
+/*
+ * Returns a channel receiving RUN and HALT as runs start and stop, and a
+ * function that stops them. Changes are dropped rather than block a run when
+ * the channel is full.
+ */
+func (m *mic1) Subscribe() (<-chan int, func()) {
+	c := make(chan int, 16)
+	m.ctlLock.Lock()
+	defer m.ctlLock.Unlock()
+	if m.subs == nil {
+		m.subs = make(map[chan int]bool)
+	}
+	m.subs[c] = true
+	return c, func() {
+		m.ctlLock.Lock()
+		defer m.ctlLock.Unlock()
+		delete(m.subs, c)
+	}
+}
+
+func (m *mic1) publishState(s int) {
+	m.ctlLock.Lock()
+	defer m.ctlLock.Unlock()
+	for c := range m.subs {
+		select {
+		case c <- s:
+		default:
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Fails the test if f hasn't returned within a few seconds */
+func finishes(t *testing.T, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not return", what)
+	}
+}
+
+func TestResetHalted(t *testing.T) {
+	m := testMic1(t)
+	for i := 0; i < 20; i++ {
+		if err := m.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finishes(t, "Reset", m.Reset)
+	finishes(t, "a second Reset", m.Reset)
+	if m.Running() || m.MPC != 0 || m.Cycles != 0 || m.Registers[REG_PC] != 0 {
+		t.Errorf("after Reset: running %v, MPC %d, %d cycles, PC %d", m.Running(), m.MPC, m.Cycles, m.Registers[REG_PC])
+	}
+	finishes(t, "Wait", m.Wait)
+	finished, err := m.Start(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Halt()
+	finishes(t, "the run", func() { <-finished })
+}
+
+func TestResetRunning(t *testing.T) {
+	m := testMic1(t)
+	if _, err := m.Start(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	finishes(t, "Reset", m.Reset)
+	if m.Running() {
+		t.Error("still running after Reset")
+	}
+}
+
+func TestReloadRefusesRuns(t *testing.T) {
+	m := testMic1(t)
+	var startErr, stepErr error
+	err := m.Reload(func(m *mic1) error {
+		/* from another goroutine as a client would, the registers are locked here */
+		finishes(t, "Start and Step", func() {
+			_, startErr = m.Start(context.Background(), nil)
+			stepErr = m.Step()
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startErr != ErrRunning || stepErr != ErrRunning {
+		t.Errorf("during Reload Start gave %v and Step gave %v, want %v", startErr, stepErr, ErrRunning)
+	}
+	if err := m.Step(); err != nil {
+		t.Errorf("Step after Reload: %s", err)
+	}
+}
+
+/*
+ * Starts, halts, steps, waits for, resets and reloads the machine from
+ * several goroutines at once. Run with -race.
+ */
+func TestControllerConcurrent(t *testing.T) {
+	m := testMic1(t)
+	mc := benchWords(t)
+	stop := time.Now().Add(300 * time.Millisecond)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	errs := make([]error, 0)
+	fail := func(err error) {
+		lock.Lock()
+		errs = append(errs, err)
+		lock.Unlock()
+	}
+	loop := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(stop) {
+				f()
+			}
+		}()
+	}
+	loop(func() {
+		if _, err := m.Start(context.Background(), nil); err != nil && err != ErrRunning {
+			fail(err)
+		}
+	})
+	loop(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		if err := m.Run(ctx); err != nil && err != ErrRunning && err != context.DeadlineExceeded {
+			fail(err)
+		}
+		cancel()
+	})
+	loop(m.Halt)
+	loop(m.Wait)
+	loop(m.Reset)
+	loop(func() {
+		if err := m.Step(); err != nil && err != ErrRunning {
+			fail(err)
+		}
+	})
+	loop(func() {
+		if err := m.StepInstruction(100); err != nil && err != ErrRunning {
+			fail(err)
+		}
+	})
+	loop(func() {
+		/* an empty control store would fault a run that got in part way through */
+		m.Reload(func(m *mic1) error {
+			m.resetRegisters()
+			m.ZeroMem()
+			m.ZeroMC()
+			m.LoadMC(mc)
+			return nil
+		})
+	})
+	loop(func() {
+		m.RegistersLock.Lock()
+		_ = m.Registers[REG_AC] + uint16(m.MPC)
+		m.RegistersLock.Unlock()
+	})
+	finishes(t, "the goroutines", wg.Wait)
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	m.Halt()
+	finishes(t, "Wait", m.Wait)
+	if m.Running() {
+		t.Error("still running after Halt and Wait")
+	}
+	if err := m.Step(); err != nil {
+		t.Errorf("Step after the runs: %s", err)
+	}
+}
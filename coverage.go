@@ -0,0 +1,159 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+/* Execution counts for every microcode slot */
+type Coverage struct {
+	Hits     [256]uint64
+	Taken    [256]uint64
+	NotTaken [256]uint64
+}
+
+type CoverageEntry struct {
+	Addr        uint8  `json:"addr"`
+	Instruction string `json:"instruction"`
+	Hits        uint64 `json:"hits"`
+	Conditional bool   `json:"conditional"`
+	Taken       uint64 `json:"taken"`
+	NotTaken    uint64 `json:"not_taken"`
+}
+
+type CoverageSummary struct {
+	Instructions         int `json:"instructions"`
+	Executed             int `json:"executed"`
+	Branches             int `json:"branches"`
+	BranchesCovered      int `json:"branches_covered"`
+	BranchesTakenOnly    int `json:"branches_taken_only"`
+	BranchesNotTakenOnly int `json:"branches_not_taken_only"`
+}
+
+type CoverageReport struct {
+	Summary      CoverageSummary `json:"summary"`
+	Instructions []CoverageEntry `json:"instructions"`
+}
+
+/* Records one execution of the instruction at addr */
+func (c *Coverage) Record(addr uint8, ins *instruction, taken bool) {
+	c.Hits[addr]++
+	if ins.COND == 1 || ins.COND == 2 {
+		if taken {
+			c.Taken[addr]++
+		} else {
+			c.NotTaken[addr]++
+		}
+	}
+}
+
+/* Builds a report for every loaded microcode instruction */
+func (c *Coverage) Report(m *mic1) CoverageReport {
+	r := CoverageReport{Instructions: make([]CoverageEntry, 0, 256)}
+	for i, ins := range m.MCC {
+		if ins == nil {
+			continue
+		}
+		e := CoverageEntry{Addr: uint8(i), Instruction: ins.ToString(), Hits: c.Hits[i]}
+		r.Summary.Instructions++
+		if e.Hits > 0 {
+			r.Summary.Executed++
+		}
+		if ins.COND == 1 || ins.COND == 2 {
+			e.Conditional = true
+			e.Taken = c.Taken[i]
+			e.NotTaken = c.NotTaken[i]
+			r.Summary.Branches++
+			switch {
+			case e.Taken > 0 && e.NotTaken > 0:
+				r.Summary.BranchesCovered++
+			case e.Taken > 0:
+				r.Summary.BranchesTakenOnly++
+			case e.NotTaken > 0:
+				r.Summary.BranchesNotTakenOnly++
+			}
+		}
+		r.Instructions = append(r.Instructions, e)
+	}
+	return r
+}
+
+/* Writes the microcode listing annotated with execution and branch counts */
+func (c *Coverage) WriteListing(w io.Writer, m *mic1) error {
+	r := c.Report(m)
+	for _, e := range r.Instructions {
+		hits := "#####"
+		if e.Hits > 0 {
+			hits = fmt.Sprintf("%d", e.Hits)
+		}
+		note := ""
+		if e.Conditional && e.Hits > 0 {
+			note = fmt.Sprintf("  [taken %d, not taken %d]", e.Taken, e.NotTaken)
+			if e.Taken == 0 {
+				note += " never taken"
+			} else if e.NotTaken == 0 {
+				note += " always taken"
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%10s %3d: %s%s\n", hits, e.Addr, e.Instruction, note); err != nil {
+			return err
+		}
+	}
+	s := r.Summary
+	_, err := fmt.Fprintf(w, "\nExecuted %d of %d instructions\nBoth directions taken for %d of %d conditional jumps (%d only taken, %d only not taken)\n",
+		s.Executed, s.Instructions, s.BranchesCovered, s.Branches, s.BranchesTakenOnly, s.BranchesNotTakenOnly)
+	return err
+}
+
+/* Writes the coverage report as JSON */
+func (c *Coverage) WriteJSON(w io.Writer, m *mic1) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.Report(m))
+}
+
+/* Writes the listing and JSON reports to the given files, skipping empty file names */
+func SaveCoverage(m *mic1, listing string, js string) error {
+	files := []struct {
+		name  string
+		write func(io.Writer, *mic1) error
+	}{
+		{listing, m.Coverage.WriteListing},
+		{js, m.Coverage.WriteJSON},
+	}
+	for _, f := range files {
+		if f.name == "" {
+			continue
+		}
+		file, err := os.Create(f.name)
+		if err != nil {
+			return err
+		}
+		err = f.write(file, m)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		log.Println("Wrote microcode coverage to", f.name)
+	}
+	return nil
+}
@@ -0,0 +1,790 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * A Debug Adapter Protocol server. Stepping is per macro instruction, a
+ * stepIn with "instruction" granularity (or the custom microStep request)
+ * executes a single microinstruction. Source breakpoints and frames use the
+ * machine's line maps, so they are on lines of the assembly source.
+ */
+
+/* Variable references for the scopes, memory is split into blocks of DAP_BLOCK words */
+const (
+	DAP_REGISTERS = 1
+	DAP_MEMORY    = 2
+	DAP_SYMBOLS   = 3
+	DAP_BLOCKS    = 1000
+	DAP_BLOCK     = 64
+)
+
+type DAPServer struct {
+	Mic *mic1
+
+	w     io.Writer
+	wlock sync.Mutex
+	seq   int
+	/* Set atomically by a pause request so the run stops with reason pause */
+	paused int32
+	/* Breakpoints per source path and for the function and instruction requests */
+	bps map[string][]uint16
+	/* Source breakpoint lines per path, so they can be placed again when the line maps change */
+	srcLines    map[string][]int
+	stopOnEntry bool
+	started     bool
+	/* Closed once the response to the request being handled is written, events it causes wait for it */
+	replied chan struct{}
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+/* Serves one client on stdin and stdout, or clients on a local socket one at a time */
+func (s *DAPServer) ListenAndServe(addr string) error {
+	if addr == "stdio" || addr == "-" {
+		return s.Serve(os.Stdin, os.Stdout)
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Println("Waiting for a debug adapter client on", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		err = s.Serve(conn, conn)
+		conn.Close()
+		if err != nil && err != io.EOF {
+			log.Println("dap:", err.Error())
+		}
+	}
+}
+
+/* Handles requests until the client disconnects */
+func (s *DAPServer) Serve(r io.Reader, w io.Writer) error {
+	s.wlock.Lock()
+	s.w = w
+	s.wlock.Unlock()
+	s.bps = make(map[string][]uint16)
+	s.srcLines = make(map[string][]int)
+	if !s.started {
+		s.started = true
+		/* unless a serial backend owns the serial port */
+		if !s.Mic.SerialExternal {
+			go s.forwardOutput()
+		}
+	}
+	br := bufio.NewReader(r)
+	for {
+		req, err := dapRead(br)
+		if err != nil {
+			return err
+		}
+		s.replied = make(chan struct{})
+		body, err := s.handle(req)
+		if err != nil {
+			s.respond(req, false, err.Error(), nil)
+			close(s.replied)
+			continue
+		}
+		s.respond(req, true, "", body)
+		close(s.replied)
+		switch req.Command {
+		case "initialize":
+			s.event("initialized", nil)
+		case "configurationDone":
+			s.configured()
+		case "terminate":
+			s.event("terminated", nil)
+		case "disconnect":
+			s.halt()
+			return nil
+		}
+	}
+}
+
+func dapRead(r *bufio.Reader) (*dapRequest, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-Length:") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[15:]))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	req := &dapRequest{}
+	if err := json.Unmarshal(buf, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *DAPServer) send(msg map[string]interface{}) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	s.seq++
+	msg["seq"] = s.seq
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("dap:", err.Error())
+		return
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+}
+
+func (s *DAPServer) respond(req *dapRequest, success bool, message string, body interface{}) {
+	msg := map[string]interface{}{"type": "response", "request_seq": req.Seq, "command": req.Command, "success": success}
+	if message != "" {
+		msg["message"] = message
+	}
+	if body != nil {
+		msg["body"] = body
+	}
+	s.send(msg)
+}
+
+func (s *DAPServer) event(name string, body interface{}) {
+	msg := map[string]interface{}{"type": "event", "event": name}
+	if body != nil {
+		msg["body"] = body
+	}
+	s.send(msg)
+}
+
+/* Sends a stopped event, reason is why the machine was started or stepped */
+func (s *DAPServer) stopped(reason string) {
+	m := s.Mic
+	m.RegistersLock.Lock()
+	atBreak := m.MPC == 0 && m.IsPCBR(m.Registers[REG_PC])
+	halted := m.MPC == 0 && m.Registers[REG_IR]&0xFF00 == MACRO_HALT
+	fault := m.Fault
+	m.RegistersLock.Unlock()
+	desc := ""
+	switch {
+	case fault != nil:
+		reason = "exception"
+		desc = fault.Error()
+	case reason == "pause":
+	case atBreak:
+		reason = "breakpoint"
+	case halted:
+		reason = "pause"
+		desc = "Program halted"
+	}
+	body := map[string]interface{}{"reason": reason, "threadId": 1, "allThreadsStopped": true}
+	if desc != "" {
+		body["description"] = desc
+	}
+	s.event("stopped", body)
+}
+
+/* Serial output goes to the debug console */
+func (s *DAPServer) forwardOutput() {
+	for out := range s.Mic.Output {
+		s.event("output", map[string]interface{}{"category": "stdout", "output": out})
+	}
+}
+
+/*
+ * Starts a run that stops at the condition made from the halted machine, or
+ * only at breakpoints when cond is nil, and sends a stopped event when it has
+ * and the response to the request has been written.
+ */
+func (s *DAPServer) run(reason string, cond func(m *mic1) func(m *mic1) bool) error {
+	m := s.Mic
+	m.RegistersLock.Lock()
+	err := s.checkMC()
+	var done func(m *mic1) bool
+	if err == nil && cond != nil {
+		done = cond(m)
+	}
+	m.RegistersLock.Unlock()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.paused, 0)
+	finished, err := m.Start(context.Background(), done)
+	if err != nil {
+		return err
+	}
+	replied := s.replied
+	go func() {
+		<-finished
+		<-replied
+		if atomic.LoadInt32(&s.paused) != 0 {
+			reason = "pause"
+		}
+		s.stopped(reason)
+	}()
+	return nil
+}
+
+func (s *DAPServer) halt() {
+	atomic.StoreInt32(&s.paused, 1)
+	s.Mic.Halt()
+}
+
+/* Returns an error when there is no microinstruction at MPC to execute, the machine must be locked */
+func (s *DAPServer) checkMC() error {
+	if s.Mic.MCC[s.Mic.MPC] == nil {
+		return errors.New(fmt.Sprintf("no microinstruction is loaded at MPC %d", s.Mic.MPC))
+	}
+	return nil
+}
+
+/* Paths are made absolute so the client can open them */
+func dapSourceOf(loc SourceLoc) *dapSource {
+	path, err := filepath.Abs(loc.File)
+	if err != nil {
+		path = loc.File
+	}
+	return &dapSource{Name: filepath.Base(loc.File), Path: path}
+}
+
+/* Places breakpoints on source lines, a line without code gets the next line that has some */
+func (s *DAPServer) setSourceBreakpoints(path string, lines []int) []map[string]interface{} {
+	m := s.Mic
+	ret := make([]map[string]interface{}, 0)
+	addrs := make([]uint16, 0)
+	m.RegistersLock.Lock()
+	for _, line := range lines {
+		a, ok := m.AddrForSource(path, line)
+		bp := map[string]interface{}{"verified": ok, "line": line}
+		if ok {
+			addrs = append(addrs, a)
+			bp["instructionReference"] = fmt.Sprintf("0x%03x", a)
+			if loc, ok := m.SourceFor(a); ok {
+				bp["line"] = loc.Line
+			}
+		} else {
+			bp["message"] = "no code on or after this line"
+		}
+		ret = append(ret, bp)
+	}
+	m.RegistersLock.Unlock()
+	s.srcLines[path] = lines
+	s.bps["source:"+path] = addrs
+	s.updateBreakpoints()
+	return ret
+}
+
+/* Recomputes the machine's PC breakpoints from every breakpoint request */
+func (s *DAPServer) updateBreakpoints() {
+	s.Mic.RegistersLock.Lock()
+	defer s.Mic.RegistersLock.Unlock()
+	s.Mic.PCBR = nil
+	for _, v := range s.bps {
+		for _, a := range v {
+			s.Mic.AddPCBR(a)
+		}
+	}
+}
+
+func dapFormat(v uint16, hex bool) string {
+	if hex {
+		return fmt.Sprintf("0x%04x", v)
+	}
+	return fmt.Sprintf("%d", int16(v))
+}
+
+func (s *DAPServer) handle(req *dapRequest) (interface{}, error) {
+	m := s.Mic
+	var args struct {
+		/* launch */
+		MC          string `json:"mc"`
+		MCS         string `json:"mcs"`
+		Microcode   string `json:"microcode"`
+		Mem         string `json:"m"`
+		MemS        string `json:"ms"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+		/* breakpoints */
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line                 int    `json:"line"`
+			Name                 string `json:"name"`
+			InstructionReference string `json:"instructionReference"`
+			Offset               int    `json:"offset"`
+		} `json:"breakpoints"`
+		/* stepping */
+		Granularity string `json:"granularity"`
+		/* variables */
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+		Format             struct {
+			Hex bool `json:"hex"`
+		} `json:"format"`
+		/* memory */
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int    `json:"offset"`
+		Count             int    `json:"count"`
+		Data              string `json:"data"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+		/* evaluate */
+		Expression string `json:"expression"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsInstructionBreakpoints":   true,
+			"supportsSetVariable":              true,
+			"supportsReadMemoryRequest":        true,
+			"supportsWriteMemoryRequest":       true,
+			"supportsDisassembleRequest":       true,
+			"supportsSteppingGranularity":      true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch", "attach":
+		return nil, s.launch(args.MC, args.MCS, args.Microcode, args.Mem, args.MemS, args.StopOnEntry)
+	case "configurationDone":
+		return nil, nil
+	case "setBreakpoints":
+		lines := make([]int, 0, len(args.Breakpoints))
+		for _, b := range args.Breakpoints {
+			lines = append(lines, b.Line)
+		}
+		return map[string]interface{}{"breakpoints": s.setSourceBreakpoints(args.Source.Path, lines)}, nil
+	case "setFunctionBreakpoints", "setInstructionBreakpoints":
+		ret := make([]map[string]interface{}, 0)
+		addrs := make([]uint16, 0)
+		m.RegistersLock.Lock()
+		for _, b := range args.Breakpoints {
+			ref := b.Name
+			if req.Command == "setInstructionBreakpoints" {
+				ref = b.InstructionReference
+			}
+			a, err := m.Eval(ref)
+			a += uint16(b.Offset)
+			bp := map[string]interface{}{"verified": err == nil && int(a) < len(m.Memory)}
+			if err == nil {
+				addrs = append(addrs, a)
+				bp["instructionReference"] = fmt.Sprintf("0x%03x", a)
+			} else {
+				bp["message"] = err.Error()
+			}
+			ret = append(ret, bp)
+		}
+		m.RegistersLock.Unlock()
+		s.bps[req.Command] = addrs
+		s.updateBreakpoints()
+		return map[string]interface{}{"breakpoints": ret}, nil
+	case "threads":
+		return map[string]interface{}{"threads": []map[string]interface{}{{"id": 1, "name": "mic1"}}}, nil
+	case "stackTrace":
+		return map[string]interface{}{"stackFrames": s.stackFrames()}, nil
+	case "scopes":
+		return map[string]interface{}{"scopes": []map[string]interface{}{
+			{"name": "Registers", "variablesReference": DAP_REGISTERS, "expensive": false, "presentationHint": "registers"},
+			{"name": "Symbols", "variablesReference": DAP_SYMBOLS, "expensive": false},
+			{"name": "Memory", "variablesReference": DAP_MEMORY, "expensive": true},
+		}}, nil
+	case "variables":
+		return map[string]interface{}{"variables": s.variables(args.VariablesReference, args.Format.Hex)}, nil
+	case "setVariable":
+		v, err := s.setVariable(args.VariablesReference, args.Name, args.Value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"value": dapFormat(v, args.Format.Hex)}, nil
+	case "continue":
+		if err := s.run("breakpoint", nil); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	case "next":
+		return nil, s.run("step", (*mic1).StepOverCond)
+	case "stepIn":
+		if args.Granularity == "instruction" {
+			return nil, s.microStep()
+		}
+		return nil, s.run("step", (*mic1).StepCond)
+	case "microStep":
+		return nil, s.microStep()
+	case "stepOut":
+		return nil, s.run("step", (*mic1).StepOutCond)
+	case "pause":
+		s.halt()
+		return nil, nil
+	case "readMemory":
+		return s.readMemory(args.MemoryReference, args.Offset, args.Count)
+	case "writeMemory":
+		return s.writeMemory(args.MemoryReference, args.Offset, args.Data)
+	case "disassemble":
+		return s.disassemble(args.MemoryReference, args.InstructionOffset, args.InstructionCount)
+	case "evaluate":
+		return s.evaluate(args.Expression, args.Format.Hex)
+	case "terminate":
+		s.halt()
+		return nil, nil
+	case "disconnect":
+		return nil, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported request \"%s\"", req.Command))
+}
+
+/* Loads any files given in the launch arguments */
+func (s *DAPServer) launch(mc, mcs, microcode, mem, mems string, stopOnEntry bool) error {
+	m := s.Mic
+	if mc != "" || mcs != "" || microcode != "" {
+		fname, format := microcode, "auto"
+		if mc != "" {
+			fname, format = mc, "mc"
+		} else if mcs != "" {
+			fname, format = mcs, "mcs"
+		}
+		img, err := LoadMCFile(fname, format)
+		if err != nil {
+			return err
+		}
+		m.Reload(func(m *mic1) error {
+			m.ZeroMC()
+			m.LoadMCImage(img)
+			return nil
+		})
+	}
+	if mem != "" || mems != "" {
+		f := MemFile{File: mem, Format: "m"}
+		if mem == "" {
+			f = MemFile{File: mems, Format: "ms"}
+		}
+		err := m.Reload(func(m *mic1) error {
+			return m.ReplaceMem([]MemFile{f})
+		})
+		if err != nil {
+			return err
+		}
+		/* the line maps came with the memory */
+		for path, lines := range s.srcLines {
+			s.setSourceBreakpoints(path, lines)
+		}
+	}
+	s.stopOnEntry = stopOnEntry
+	return nil
+}
+
+/* Starts the program unless the launch asked to stop on entry */
+func (s *DAPServer) configured() {
+	if s.stopOnEntry {
+		s.stopped("entry")
+		return
+	}
+	if err := s.run("breakpoint", nil); err != nil {
+		s.event("output", map[string]interface{}{"category": "stderr", "output": err.Error() + "\n"})
+		s.stopped("exception")
+	}
+}
+
+/* Executes a single microinstruction, the stopped event follows the response */
+func (s *DAPServer) microStep() error {
+	s.Mic.RegistersLock.Lock()
+	err := s.checkMC()
+	s.Mic.RegistersLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := s.Mic.Step(); err != nil {
+		return err
+	}
+	replied := s.replied
+	go func() {
+		<-replied
+		s.stopped("step")
+	}()
+	return nil
+}
+
+func (s *DAPServer) frame(id int, pc uint16) map[string]interface{} {
+	m := s.Mic
+	f := map[string]interface{}{
+		"id":                          id,
+		"name":                        fmt.Sprintf("%s: %s", m.AddrName(pc), m.Disassemble(m.Memory[pc])),
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": fmt.Sprintf("0x%03x", pc),
+	}
+	if loc, ok := m.SourceFor(pc); ok {
+		f["source"] = dapSourceOf(loc)
+		f["line"] = loc.Line
+		f["column"] = 1
+	}
+	return f
+}
+
+func (s *DAPServer) stackFrames() []map[string]interface{} {
+	m := s.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	ret := []map[string]interface{}{s.frame(0, m.CurrentPC())}
+	for i := len(m.CallStack) - 1; i >= 0; i-- {
+		ret = append(ret, s.frame(len(ret), m.CallStack[i]))
+	}
+	return ret
+}
+
+func (s *DAPServer) variables(ref int, hex bool) []map[string]interface{} {
+	m := s.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	ret := make([]map[string]interface{}, 0)
+	variable := func(name string, v uint16, mref string) {
+		vr := map[string]interface{}{"name": name, "value": dapFormat(v, hex), "variablesReference": 0}
+		if mref != "" {
+			vr["memoryReference"] = mref
+		}
+		ret = append(ret, vr)
+	}
+	switch {
+	case ref == DAP_REGISTERS:
+		for i, v := range m.Registers {
+			variable(RegIdToNames[i], v, "")
+		}
+		variable("MAR", m.MAR, "")
+		variable("MBR", m.MBR, "")
+		variable("MPC", uint16(m.MPC), "")
+	case ref == DAP_SYMBOLS:
+		for _, sym := range m.SortedSymbols() {
+			variable(sym.Name, m.Memory[sym.Val&0x0FFF], fmt.Sprintf("0x%03x", sym.Val&0x0FFF))
+		}
+	case ref == DAP_MEMORY:
+		for b := 0; b < len(m.Memory)/DAP_BLOCK; b++ {
+			ret = append(ret, map[string]interface{}{
+				"name":               fmt.Sprintf("0x%03x-0x%03x", b*DAP_BLOCK, (b+1)*DAP_BLOCK-1),
+				"value":              "",
+				"variablesReference": DAP_BLOCKS + b,
+				"indexedVariables":   DAP_BLOCK,
+			})
+		}
+	case ref >= DAP_BLOCKS && ref < DAP_BLOCKS+len(m.Memory)/DAP_BLOCK:
+		base := (ref - DAP_BLOCKS) * DAP_BLOCK
+		for i := base; i < base+DAP_BLOCK; i++ {
+			variable(fmt.Sprintf("0x%03x", i), m.Memory[i], fmt.Sprintf("0x%03x", i))
+		}
+	}
+	return ret
+}
+
+/* Sets a variable to the value of an expression and returns the value */
+func (s *DAPServer) setVariable(ref int, name string, expr string) (uint16, error) {
+	m := s.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	v, err := m.Eval(expr)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case ref == DAP_REGISTERS:
+		if !m.SetRegister(name, v) {
+			return 0, errors.New(fmt.Sprintf("unknown register \"%s\"", name))
+		}
+		return v, nil
+	case ref == DAP_SYMBOLS:
+		for _, sym := range m.MemSymbols {
+			if sym.Name == name {
+				m.Memory[sym.Val&0x0FFF] = v
+				return v, nil
+			}
+		}
+	case ref >= DAP_BLOCKS:
+		addr, err := strconv.ParseUint(name, 0, 16)
+		if err == nil && int(addr) < len(m.Memory) {
+			m.Memory[addr] = v
+			return v, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("can not set \"%s\"", name))
+}
+
+/* Memory references are word addresses, offsets and counts are in bytes of big-endian words */
+func (s *DAPServer) readMemory(ref string, offset int, count int) (interface{}, error) {
+	if count < 0 {
+		return nil, errors.New("count must not be negative")
+	}
+	m := s.Mic
+	if count > len(m.Memory)*2 {
+		count = len(m.Memory) * 2
+	}
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	base, err := m.Eval(ref)
+	if err != nil {
+		return nil, err
+	}
+	start := int(base)*2 + offset
+	if start < 0 {
+		start = 0
+	}
+	end := start + count
+	if end > len(m.Memory)*2 {
+		end = len(m.Memory) * 2
+	}
+	buf := make([]byte, 0, count)
+	for i := start; i < end; i++ {
+		if i%2 == 0 {
+			buf = append(buf, byte(m.Memory[i/2]>>8))
+		} else {
+			buf = append(buf, byte(m.Memory[i/2]))
+		}
+	}
+	return map[string]interface{}{
+		"address":         fmt.Sprintf("0x%03x", start/2),
+		"data":            base64.StdEncoding.EncodeToString(buf),
+		"unreadableBytes": count - len(buf),
+	}, nil
+}
+
+func (s *DAPServer) writeMemory(ref string, offset int, data string) (interface{}, error) {
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	m := s.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	base, err := m.Eval(ref)
+	if err != nil {
+		return nil, err
+	}
+	start := int(base)*2 + offset
+	n := 0
+	for i, b := range buf {
+		a := start + i
+		if a < 0 || a >= len(m.Memory)*2 {
+			break
+		}
+		if a%2 == 0 {
+			m.Memory[a/2] = m.Memory[a/2]&0x00FF | uint16(b)<<8
+		} else {
+			m.Memory[a/2] = m.Memory[a/2]&0xFF00 | uint16(b)
+		}
+		n++
+	}
+	return map[string]interface{}{"bytesWritten": n}, nil
+}
+
+func (s *DAPServer) disassemble(ref string, offset int, count int) (interface{}, error) {
+	if count < 0 {
+		return nil, errors.New("instructionCount must not be negative")
+	}
+	m := s.Mic
+	if count > len(m.Memory) {
+		count = len(m.Memory)
+	}
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	base, err := m.Eval(ref)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]map[string]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		a := int(base) + offset + i
+		if a < 0 || a >= len(m.Memory) {
+			ret = append(ret, map[string]interface{}{"address": fmt.Sprintf("0x%03x", a&0xFFFF), "instruction": "", "presentationHint": "invalid"})
+			continue
+		}
+		ins := map[string]interface{}{
+			"address":          fmt.Sprintf("0x%03x", a),
+			"instructionBytes": fmt.Sprintf("%04x", m.Memory[a]),
+			"instruction":      m.DisassembleAt(uint16(a)),
+		}
+		if sym, ok := m.SymbolAt(uint16(a)); ok {
+			ins["symbol"] = sym.Name
+		}
+		if loc, ok := m.SourceFor(uint16(a)); ok {
+			ins["location"] = dapSourceOf(loc)
+			ins["line"] = loc.Line
+		}
+		ret = append(ret, ins)
+	}
+	return map[string]interface{}{"instructions": ret}, nil
+}
+
+/* Evaluates an expression as the debugger commands do, a symbol also shows the word it labels */
+func (s *DAPServer) evaluate(expr string, hex bool) (interface{}, error) {
+	m := s.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	v, err := m.Eval(expr)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]interface{}{"result": dapFormat(v, hex), "variablesReference": 0}
+	if sym, ok := m.LookupSymbol(strings.TrimSpace(expr)); ok {
+		ret["result"] = fmt.Sprintf("%s (mem[%d] = %s)", dapFormat(v, hex), sym, dapFormat(m.Memory[sym&0x0FFF], hex))
+		ret["memoryReference"] = fmt.Sprintf("0x%03x", sym&0x0FFF)
+	}
+	return ret, nil
+}
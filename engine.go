@@ -0,0 +1,198 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The execution engine. Microinstructions are decoded into a flat table
+ * before running so a cycle doesn't follow instruction pointers, and runs take
+ * the registers lock once per batch of cycles rather than once per cycle.
+ * Halt requests are atomic so any goroutine can stop a run.
+ */
+
+/* Cycles run between releases of the registers lock */
+const RUN_BATCH = 4096
+
+/* A microinstruction decoded for the engine, A is MBR_BUS when AMUX selects MBR */
+type microOp struct {
+	A, B, C  uint8
+	ALU, SH  uint8
+	COND     uint8
+	ADDR     uint8
+	MAR, MBR bool
+	RD, WR   bool
+	ENC      bool
+	BR       bool
+	Valid    bool
+}
+
+/* Index of the A bus source that is MBR rather than a register */
+const MBR_BUS = 16
+
+func decodeOp(ins *instruction) microOp {
+	if ins == nil {
+		return microOp{}
+	}
+	op := microOp{
+		A: uint8(ins.A), B: uint8(ins.B), C: uint8(ins.C),
+		ALU: uint8(ins.ALU), SH: uint8(ins.SH), COND: uint8(ins.COND), ADDR: ins.ADDR,
+		MAR: ins.MAR == 1, MBR: ins.MBR == 1, RD: ins.RD == 1, WR: ins.WR == 1, ENC: ins.ENC == 1,
+		BR: ins.BR, Valid: true,
+	}
+	if ins.AMUX == 1 {
+		op.A = MBR_BUS
+	}
+	return op
+}
+
+/* Marks the decoded table out of date after the control store or its breakpoints change */
+func (m *mic1) MCChanged() {
+	atomic.StoreInt32(&m.opsStale, 1)
+}
+
+/* Decodes the control store again if it has changed, the machine must be locked */
+func (m *mic1) decodeOps() {
+	if atomic.LoadInt32(&m.opsStale) != 0 {
+		m.redecodeOps()
+	}
+}
+
+func (m *mic1) redecodeOps() {
+	atomic.StoreInt32(&m.opsStale, 0)
+	for i, v := range m.MCC {
+		m.Ops[i] = decodeOp(v)
+	}
+}
+
+/* Sets or clears the breakpoint on a microcode slot */
+func (m *mic1) SetMCBreak(slot int, on bool) {
+	if m.MCC[slot] != nil {
+		m.MCC[slot].BR = on
+		m.MCChanged()
+	}
+}
+
+func (m *mic1) DesiredState() int8 {
+	return int8(atomic.LoadInt32(&m.desiredState))
+}
+
+/* Requests a run or a halt, use Start and Halt outside the engine */
+func (m *mic1) setDesiredState(s int8) {
+	atomic.StoreInt32(&m.desiredState, int32(s))
+}
+
+/* Hands a waiting serial input character to the receiver, the machine must be locked */
+func (m *mic1) pollInput() {
+	select {
+	case in := <-m.Input:
+		m.Memory[m.SerialBase] = uint16(in[0])
+		m.RCRV = 10
+	default:
+	}
+}
+
+/*
+ * Runs up to n cycles under one hold of the lock, stopping early when a halt
+ * is requested or done returns true at a macro instruction fetch. Returns the
+ * number of cycles run.
+ */
+func (m *mic1) runBatch(n int, done func(m *mic1) bool) int {
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	m.decodeOps()
+	i := 0
+	for i < n && m.DesiredState() == RUN {
+		m.cycle()
+		i++
+		if done != nil && m.MPC == 0 && done(m) {
+			m.setDesiredState(HALT)
+		}
+	}
+	if m.BatchInput && m.RCRV&9 == 9 {
+		m.pollInput()
+	}
+	return i
+}
+
+/*
+ * Runs the loaded program for n cycles, first with a Step per cycle, taking
+ * the lock and checking the state every cycle as stepping from a UI does, and
+ * then in batches as a run does, and returns the emulated MHz of each. Both
+ * use the current engine, so this compares per-cycle Step with batched runs,
+ * not the engine before predecoding. The program starts again from the loaded
+ * memory whenever it halts.
+ */
+func Benchmark(m *mic1, n uint64) (float64, float64) {
+	mem := m.Memory
+	restart := func() {
+		m.Reset()
+		m.RegistersLock.Lock()
+		m.Memory = mem
+		m.RegistersLock.Unlock()
+		m.setDesiredState(RUN)
+	}
+	/* nothing reads serial output while benchmarking */
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-m.Output:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+
+	restart()
+	start := time.Now()
+	for i := uint64(0); i < n; i++ {
+		m.Step()
+		if m.DesiredState() != RUN {
+			restart()
+		}
+	}
+	stepped := float64(n) / time.Since(start).Seconds() / 1e6
+
+	restart()
+	start = time.Now()
+	for ran := uint64(0); ran < n; {
+		batch := RUN_BATCH
+		if n-ran < uint64(batch) {
+			batch = int(n - ran)
+		}
+		ran += uint64(m.runBatch(batch, nil))
+		if m.DesiredState() != RUN {
+			restart()
+		}
+	}
+	batched := float64(n) / time.Since(start).Seconds() / 1e6
+	m.setDesiredState(HALT)
+	return stepped, batched
+}
+
+func PrintBenchmark(m *mic1, n uint64) {
+	stepped, batched := Benchmark(m, n)
+	fmt.Printf("%d cycles\n", n)
+	fmt.Printf("per-cycle Step: %8.2f MHz\n", stepped)
+	fmt.Printf("batched:        %8.2f MHz (%.1fx)\n", batched, batched/stepped)
+}
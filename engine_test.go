@@ -0,0 +1,90 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+/*
+ * The fetch, decode and LODD microinstructions of the standard control
+ * store. Memory is all zeros, so the program is LODD 0 forever.
+ */
+var benchMC = []string{
+	"00000000110000000000000000000000",
+	"00000000010100000110000000000000",
+	"10110000000100110000000000011100",
+	"00100100000101000011001100010011",
+	"00110100000101000000010000001011",
+	"00110000000000000000010000001001",
+	"00000000110000000011000000000000",
+	"00000000010000000000000000000000",
+	"11110000000100010000000000000000",
+}
+
+func benchWords(tb testing.TB) []uint32 {
+	mc := make([]uint32, len(benchMC))
+	for i, v := range benchMC {
+		w, err := strconv.ParseUint(v, 2, 32)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		mc[i] = uint32(w)
+	}
+	return mc
+}
+
+/* A machine with benchMC loaded */
+func testMic1(tb testing.TB) *mic1 {
+	m := InitMic1()
+	m.LoadMC(benchWords(tb))
+	return m
+}
+
+func benchMic1(b *testing.B) *mic1 {
+	m := testMic1(b)
+	b.ResetTimer()
+	return m
+}
+
+/* One Step, and so one lock, per cycle as the TUI and debuggers do */
+func BenchmarkStep(b *testing.B) {
+	m := benchMic1(b)
+	for i := 0; i < b.N; i++ {
+		if err := m.Step(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+/* Batches of cycles as Start runs them */
+func BenchmarkRun(b *testing.B) {
+	m := benchMic1(b)
+	m.setDesiredState(RUN)
+	for ran := 0; ran < b.N; {
+		n := RUN_BATCH
+		if b.N-ran < n {
+			n = b.N - ran
+		}
+		ran += m.runBatch(n, nil)
+		if m.DesiredState() != RUN {
+			b.Fatal(m.Fault)
+		}
+	}
+	m.setDesiredState(HALT)
+}
@@ -0,0 +1,517 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ * Writing memory and microcode back out in the formats they are read in, and
+ * comparing memory with memory files and snapshots taken earlier.
+ */
+
+/* Snapshot taken whenever memory is loaded, diffs are against it by default */
+const LOADED_SNAPSHOT = "loaded"
+
+/* An inclusive range of memory addresses */
+type AddrRange struct {
+	Lo uint16
+	Hi uint16
+}
+
+/* Parses from..to, a symbol with a size, which covers its words, or a single address */
+func (m *mic1) ParseRange(s string) (AddrRange, error) {
+	r := AddrRange{}
+	if i := strings.Index(s, ".."); i >= 0 {
+		lo, err := m.Eval(s[:i])
+		if err != nil {
+			return r, err
+		}
+		hi, err := m.Eval(s[i+2:])
+		if err != nil {
+			return r, err
+		}
+		r = AddrRange{lo, hi}
+	} else {
+		found := false
+		for _, v := range m.MemSymbols {
+			if v.Name == s && v.Size > 0 {
+				r = AddrRange{v.Val, v.Val + v.Size - 1}
+				found = true
+				break
+			}
+		}
+		if !found {
+			a, err := m.Eval(s)
+			if err != nil {
+				return r, err
+			}
+			r = AddrRange{a, a}
+		}
+	}
+	if r.Lo > r.Hi || int(r.Hi) >= len(m.Memory) {
+		return r, errors.New(fmt.Sprintf("bad range \"%s\", use from..to inside memory", s))
+	}
+	return r, nil
+}
+
+/* Parses ranges and sorts them, joining ones that overlap or follow on */
+func (m *mic1) ParseRanges(args []string) ([]AddrRange, error) {
+	ranges := make([]AddrRange, 0, len(args))
+	for _, v := range args {
+		r, err := m.ParseRange(v)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Lo < ranges[j].Lo })
+	ret := make([]AddrRange, 0, len(ranges))
+	for _, r := range ranges {
+		if n := len(ret); n > 0 && int(r.Lo) <= int(ret[n-1].Hi)+1 {
+			if r.Hi > ret[n-1].Hi {
+				ret[n-1].Hi = r.Hi
+			}
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+/* Reports whether addr is in one of the ranges, no ranges means all of memory */
+func inRanges(ranges []AddrRange, addr uint16) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if addr >= r.Lo && addr <= r.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns memory as an image with one segment per range and the symbols
+ * inside them. Without ranges it is memory up to the last word that isn't 0.
+ */
+func (m *mic1) MemImageOf(ranges []AddrRange) *MemImage {
+	img := &MemImage{Segments: make([]MemSegment, 0), Symbols: make([]Symbol, 0)}
+	if len(ranges) == 0 {
+		n := len(m.Memory)
+		for n > 0 && m.Memory[n-1] == 0 {
+			n--
+		}
+		if n == 0 {
+			return img
+		}
+		ranges = []AddrRange{{0, uint16(n - 1)}}
+	}
+	for _, r := range ranges {
+		img.Segments = append(img.Segments, MemSegment{r.Lo, append([]uint16{}, m.Memory[r.Lo:int(r.Hi)+1]...)})
+	}
+	for _, v := range m.MemSymbols {
+		if inRanges(ranges, v.Val) {
+			img.Symbols = append(img.Symbols, v)
+		}
+	}
+	return img
+}
+
+/* Returns the control store up to its last instruction with the labels and comments */
+func (m *mic1) MCImageOf() *MCImage {
+	n := 0
+	for i, v := range m.MCC {
+		if v != nil {
+			n = i + 1
+		}
+	}
+	img := NewMCImage(make([]uint32, n))
+	for i := 0; i < n; i++ {
+		if v := m.MCC[i]; v != nil {
+			img.Words[i] = v.Pack()
+			img.annotate(i, v.Label, v.Comment)
+		}
+	}
+	return img
+}
+
+/* Returns the segments as one block from the lowest address, gaps are zeros */
+func (img *MemImage) flatten() (uint16, []uint16) {
+	if len(img.Segments) == 0 {
+		return 0, nil
+	}
+	lo, hi := 4096, 0
+	for _, v := range img.Segments {
+		if int(v.Base) < lo {
+			lo = int(v.Base)
+		}
+		if int(v.Base)+len(v.Words) > hi {
+			hi = int(v.Base) + len(v.Words)
+		}
+	}
+	ret := make([]uint16, hi-lo)
+	for _, v := range img.Segments {
+		copy(ret[int(v.Base)-lo:], v.Words)
+	}
+	return uint16(lo), ret
+}
+
+/* Splits bytes into records of at most 16 bytes */
+func byteRecords(addr uint32, data []byte) []ByteChunk {
+	ret := make([]ByteChunk, 0, len(data)/16+1)
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		ret = append(ret, ByteChunk{Addr: addr + uint32(i), Data: data[i:end]})
+	}
+	return ret
+}
+
+/* Records of big-endian words at byte addresses */
+func (img *MemImage) records() []ByteChunk {
+	ret := make([]ByteChunk, 0)
+	for _, v := range img.Segments {
+		data := make([]byte, 2*len(v.Words))
+		for i, w := range v.Words {
+			data[2*i] = byte(w >> 8)
+			data[2*i+1] = byte(w)
+		}
+		ret = append(ret, byteRecords(uint32(v.Base)*2, data)...)
+	}
+	return ret
+}
+
+func writeIntelHex(w io.Writer, chunks []ByteChunk) error {
+	bw := bufio.NewWriter(w)
+	record := func(kind byte, addr uint16, data []byte) {
+		rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), kind}, data...)
+		var sum byte
+		for _, v := range rec {
+			sum += v
+		}
+		fmt.Fprintf(bw, ":%X%02X\n", rec, -sum)
+	}
+	for _, c := range chunks {
+		record(0x00, uint16(c.Addr), c.Data)
+	}
+	record(0x01, 0, nil)
+	return bw.Flush()
+}
+
+/* Binary memory has no addresses, so a file of ranges is loaded back with file@base */
+func EncodeBinaryMem(w io.Writer, img *MemImage) error {
+	_, words := img.flatten()
+	buff := make([]byte, 2*len(words))
+	for i, v := range words {
+		buff[2*i] = byte(v >> 8)
+		buff[2*i+1] = byte(v)
+	}
+	_, err := w.Write(buff)
+	return err
+}
+
+/* Symbols are written relative to the first address, like the words */
+func EncodeBinaryStringMem(w io.Writer, img *MemImage) error {
+	base, words := img.flatten()
+	bw := bufio.NewWriter(w)
+	for _, v := range img.Symbols {
+		fmt.Fprintf(bw, "#%s: %d\n", v.Name, v.Val-base)
+	}
+	for _, v := range words {
+		fmt.Fprintf(bw, "%016b\n", v)
+	}
+	return bw.Flush()
+}
+
+func EncodeIntelHexMem(w io.Writer, img *MemImage) error {
+	return writeIntelHex(w, img.records())
+}
+
+func EncodeSRecordMem(w io.Writer, img *MemImage) error {
+	bw := bufio.NewWriter(w)
+	record := func(kind byte, addr uint16, data []byte) {
+		rec := append([]byte{byte(len(data) + 3), byte(addr >> 8), byte(addr)}, data...)
+		var sum byte
+		for _, v := range rec {
+			sum += v
+		}
+		fmt.Fprintf(bw, "S%c%X%02X\n", kind, rec, ^sum)
+	}
+	record('0', 0, []byte("mic1"))
+	for _, c := range img.records() {
+		record('1', uint16(c.Addr), c.Data)
+	}
+	record('9', 0, nil)
+	return bw.Flush()
+}
+
+/* Eight words a line with the characters of their low bytes after a | */
+func EncodeHexDumpMem(w io.Writer, img *MemImage) error {
+	bw := bufio.NewWriter(w)
+	for _, v := range img.Segments {
+		for i := 0; i < len(v.Words); i += 8 {
+			end := i + 8
+			if end > len(v.Words) {
+				end = len(v.Words)
+			}
+			fmt.Fprintf(bw, "%04x:", int(v.Base)+i)
+			for _, word := range v.Words[i:end] {
+				fmt.Fprintf(bw, " %04x", word)
+			}
+			fmt.Fprintf(bw, "%*s  |", 5*(8-(end-i)), "")
+			for _, word := range v.Words[i:end] {
+				c := byte(word)
+				if c < 0x20 || c > 0x7E {
+					c = '.'
+				}
+				bw.WriteByte(c)
+			}
+			fmt.Fprint(bw, "|\n")
+		}
+	}
+	return bw.Flush()
+}
+
+/* Returns "[label: ]body[ ; comment]" for a slot */
+func (img *MCImage) line(slot int, body string) string {
+	f := make([]string, 0, 3)
+	if l := img.Labels[slot]; l != "" {
+		f = append(f, l+":")
+	}
+	if body != "" {
+		f = append(f, body)
+	}
+	if c := img.Comments[slot]; c != "" {
+		f = append(f, "; "+c)
+	}
+	return strings.Join(f, " ")
+}
+
+func EncodeBinaryMC(w io.Writer, img *MCImage) error {
+	buff := make([]byte, 4*len(img.Words))
+	for i, v := range img.Words {
+		buff[4*i] = byte(v >> 24)
+		buff[4*i+1] = byte(v >> 16)
+		buff[4*i+2] = byte(v >> 8)
+		buff[4*i+3] = byte(v)
+	}
+	_, err := w.Write(buff)
+	return err
+}
+
+func EncodeBinaryStringMC(w io.Writer, img *MCImage) error {
+	bw := bufio.NewWriter(w)
+	for i, v := range img.Words {
+		fmt.Fprintln(bw, img.line(i, fmt.Sprintf("%032b", v)))
+	}
+	return bw.Flush()
+}
+
+func EncodeHexMC(w io.Writer, img *MCImage) error {
+	bw := bufio.NewWriter(w)
+	for i, v := range img.Words {
+		fmt.Fprintln(bw, img.line(i, fmt.Sprintf("%08x", v)))
+	}
+	return bw.Flush()
+}
+
+func EncodeListingMC(w io.Writer, img *MCImage) error {
+	bw := bufio.NewWriter(w)
+	for i, v := range img.Words {
+		fmt.Fprintf(bw, "%3d: %s\n", i, img.line(i, fmt.Sprintf("%032b", v)))
+	}
+	return bw.Flush()
+}
+
+func EncodeLogisimMC(w io.Writer, img *MCImage) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "v2.0 raw")
+	for i, v := range img.Words {
+		sep := " "
+		if i%8 == 7 || i == len(img.Words)-1 {
+			sep = "\n"
+		}
+		fmt.Fprintf(bw, "%x%s", v, sep)
+	}
+	return bw.Flush()
+}
+
+func EncodeIntelHexMC(w io.Writer, img *MCImage) error {
+	buff := make([]byte, 4*len(img.Words))
+	for i, v := range img.Words {
+		buff[4*i] = byte(v >> 24)
+		buff[4*i+1] = byte(v >> 16)
+		buff[4*i+2] = byte(v >> 8)
+		buff[4*i+3] = byte(v)
+	}
+	return writeIntelHex(w, byteRecords(0, buff))
+}
+
+/* Returns the format named by a file's extension, such as .srec, or "" */
+func formatForFile(fp string, aliases map[string]string, known func(string) bool) string {
+	ext := strings.TrimPrefix(filepath.Ext(fp), ".")
+	if f, ok := aliases[ext]; ok {
+		return f
+	}
+	if known(ext) {
+		return ext
+	}
+	return ""
+}
+
+func writeFile(fp string, encode func(w io.Writer) error) error {
+	file, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	if err := encode(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+ * Writes a memory image in the given format, or the one named by the file's
+ * extension, or as a hex dump. Returns the format used.
+ */
+func SaveMemFile(fp string, format string, img *MemImage) (*MemDecoder, error) {
+	if format == "" || format == "auto" {
+		format = formatForFile(fp, map[string]string{"hex": "ihex", "s19": "srec"}, func(f string) bool { return FindMemDecoder(f) != nil })
+	}
+	if format == "" {
+		format = "dump"
+	}
+	enc := FindMemDecoder(format)
+	if enc == nil {
+		return nil, errors.New(fmt.Sprintf("unknown memory format \"%s\", use %s", format, MemFormatNames()))
+	}
+	return enc, writeFile(fp, func(w io.Writer) error { return enc.Encode(w, img) })
+}
+
+/*
+ * Writes a microcode image in the given format, or the one named by the
+ * file's extension, or as binary strings. Formats without labels get a
+ * labels file next to them. Returns the format used.
+ */
+func SaveMCFile(fp string, format string, img *MCImage) (*MCDecoder, error) {
+	if format == "" || format == "auto" {
+		format = formatForFile(fp, map[string]string{"lst": "listing"}, func(f string) bool { return FindMCDecoder(f) != nil })
+	}
+	if format == "" {
+		format = "mcs"
+	}
+	enc := FindMCDecoder(format)
+	if enc == nil {
+		return nil, errors.New(fmt.Sprintf("unknown microcode format \"%s\", use %s", format, MCFormatNames()))
+	}
+	if err := writeFile(fp, func(w io.Writer) error { return enc.Encode(w, img) }); err != nil {
+		return enc, err
+	}
+	switch format {
+	case "mcs", "hex", "listing":
+		return enc, nil
+	}
+	if len(img.Labels) == 0 && len(img.Comments) == 0 {
+		return enc, nil
+	}
+	lp := strings.TrimSuffix(fp, filepath.Ext(fp)) + MC_LABEL_EXT
+	return enc, writeFile(lp, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		for i := range img.Words {
+			if img.Labels[i] != "" || img.Comments[i] != "" {
+				fmt.Fprintf(bw, "%d %s\n", i, img.line(i, ""))
+			}
+		}
+		return bw.Flush()
+	})
+}
+
+/* Saves a copy of memory and its symbols under a name to diff against later */
+func (m *mic1) TakeSnapshot(name string) {
+	if m.Snapshots == nil {
+		m.Snapshots = make(map[string]*MemImage)
+	}
+	m.Snapshots[name] = &MemImage{
+		Segments: []MemSegment{{0, append([]uint16{}, m.Memory[:]...)}},
+		Symbols:  append([]Symbol{}, m.MemSymbols...),
+	}
+}
+
+/* Returns the snapshot with the given name, or the memory file[@base], the machine must not be locked */
+func (m *mic1) MemReference(name string) (*MemImage, error) {
+	m.RegistersLock.Lock()
+	img, ok := m.Snapshots[name]
+	m.RegistersLock.Unlock()
+	if ok {
+		return img, nil
+	}
+	mf, err := ParseMemFile(name, "auto")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(mf.File); err != nil {
+		return nil, errors.New(fmt.Sprintf("no snapshot or file is called \"%s\"", name))
+	}
+	img, err = LoadMemFile(mf.File, mf.Format)
+	if err != nil {
+		return nil, err
+	}
+	img.Relocate(mf.Base)
+	return img, nil
+}
+
+/* A memory word that differs from a file or snapshot */
+type MemChange struct {
+	Addr uint16
+	Old  uint16
+	New  uint16
+}
+
+/* Compares memory with the words of an image, only inside ranges when there are any */
+func (m *mic1) DiffImage(img *MemImage, ranges []AddrRange) []MemChange {
+	ret := make([]MemChange, 0)
+	for _, v := range img.Segments {
+		for i, w := range v.Words {
+			a := int(v.Base) + i
+			if a >= len(m.Memory) {
+				break
+			}
+			if inRanges(ranges, uint16(a)) && m.Memory[a] != w {
+				ret = append(ret, MemChange{uint16(a), w, m.Memory[a]})
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Addr < ret[j].Addr })
+	return ret
+}
+
+func (m *mic1) ChangeString(c MemChange) string {
+	return fmt.Sprintf("0x%03x <%s>: 0x%04x -> 0x%04x  (%d -> %d)", c.Addr, m.AddrName(c.Addr), c.Old, c.New, int16(c.Old), int16(c.New))
+}
@@ -0,0 +1,73 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackUnpack(t *testing.T) {
+	words := append(benchWords(t), 0, 0xffffffff, 0x80000001, 0x5a5a5a5a, 0x12345678)
+	for _, w := range words {
+		ins := Unpack(w)
+		if got := ins.Pack(); got != w {
+			t.Errorf("Unpack(%#08x).Pack() = %#08x", w, got)
+		}
+	}
+}
+
+/* Microcode exported with MCImageOf loads back as the same instructions, labels and comments */
+func TestMCImageOfRoundTrip(t *testing.T) {
+	m := testMic1(t)
+	/* a gap the image fills with zeros, and a breakpoint, which isn't part of the image */
+	ins := Unpack(0x12345678)
+	m.MCC[20] = &ins
+	m.MCC[0].Label = "fetch"
+	m.MCC[0].Comment = "mar := pc; rd"
+	m.MCC[2].Label = "decode"
+	m.SetMCBreak(1, true)
+	m.ResolveMCLabels()
+
+	img := m.MCImageOf()
+	if len(img.Words) != 21 {
+		t.Fatalf("got %d words, want 21", len(img.Words))
+	}
+	for i := 9; i < 20; i++ {
+		if img.Words[i] != 0 {
+			t.Errorf("gap slot %d = %#08x, want 0", i, img.Words[i])
+		}
+	}
+
+	loaded := InitMic1()
+	loaded.LoadMCImage(img)
+	for i, v := range m.MCC {
+		got := loaded.MCC[i]
+		if v == nil {
+			/* gaps load as zero words, slots after the last stay empty */
+			if i > 20 && got != nil || i < 20 && (got == nil || got.Pack() != 0) {
+				t.Errorf("slot %d: got %+v", i, got)
+			}
+			continue
+		}
+		want := *v
+		want.BR = false
+		if got == nil || !reflect.DeepEqual(*got, want) {
+			t.Errorf("slot %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
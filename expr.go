@@ -0,0 +1,324 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+ * Expressions used by the debugger commands. Operands are numbers (decimal,
+ * 0x hex or 0b binary), registers, symbols and mem[expr]. A symbol is the
+ * address it labels and wins over a register of the same name, $name always
+ * names a register. Operators are | ^ & + - * / % and unary - and ~ with
+ * C precedence.
+ */
+
+type Expr interface {
+	Eval(m *mic1) (int, error)
+}
+
+type exprNum int
+
+type exprReg string
+
+type exprSym string
+
+type exprMem struct {
+	Addr Expr
+}
+
+type exprUnary struct {
+	Op rune
+	X  Expr
+}
+
+type exprBinary struct {
+	Op   rune
+	X, Y Expr
+}
+
+func (e exprNum) Eval(m *mic1) (int, error) {
+	return int(e), nil
+}
+
+func (e exprReg) Eval(m *mic1) (int, error) {
+	v, ok := m.Register(string(e))
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("unknown register \"%s\"", string(e)))
+	}
+	return int(v), nil
+}
+
+func (e exprSym) Eval(m *mic1) (int, error) {
+	if v, ok := m.LookupSymbol(string(e)); ok {
+		return int(v), nil
+	}
+	if v, ok := m.Register(string(e)); ok {
+		return int(v), nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown register or symbol \"%s\"", string(e)))
+}
+
+func (e exprMem) Eval(m *mic1) (int, error) {
+	a, err := e.Addr.Eval(m)
+	if err != nil {
+		return 0, err
+	}
+	if a < 0 || a >= len(m.Memory) {
+		return 0, errors.New(fmt.Sprintf("address %d is outside of memory", a))
+	}
+	return int(m.Memory[a]), nil
+}
+
+func (e exprUnary) Eval(m *mic1) (int, error) {
+	x, err := e.X.Eval(m)
+	if err != nil {
+		return 0, err
+	}
+	if e.Op == '-' {
+		return -x, nil
+	}
+	return ^x, nil
+}
+
+func (e exprBinary) Eval(m *mic1) (int, error) {
+	x, err := e.X.Eval(m)
+	if err != nil {
+		return 0, err
+	}
+	y, err := e.Y.Eval(m)
+	if err != nil {
+		return 0, err
+	}
+	switch e.Op {
+	case '|':
+		return x | y, nil
+	case '^':
+		return x ^ y, nil
+	case '&':
+		return x & y, nil
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	}
+	if y == 0 {
+		return 0, errors.New("division by zero")
+	}
+	if e.Op == '/' {
+		return x / y, nil
+	}
+	return x % y, nil
+}
+
+/* Returns a register by name, including MAR, MBR and MPC, ignoring case */
+func (m *mic1) Register(name string) (uint16, bool) {
+	for i, n := range RegIdToNames {
+		if strings.EqualFold(n, name) {
+			return m.Registers[i], true
+		}
+	}
+	switch strings.ToUpper(name) {
+	case "MAR":
+		return m.MAR, true
+	case "MBR":
+		return m.MBR, true
+	case "MPC":
+		return uint16(m.MPC), true
+	}
+	return 0, false
+}
+
+/* Sets a register by name, including MAR, MBR and MPC, ignoring case */
+func (m *mic1) SetRegister(name string, v uint16) bool {
+	for i, n := range RegIdToNames {
+		if strings.EqualFold(n, name) {
+			m.Registers[i] = v
+			return true
+		}
+	}
+	switch strings.ToUpper(name) {
+	case "MAR":
+		m.MAR = v
+	case "MBR":
+		m.MBR = v
+	case "MPC":
+		m.MPC = uint8(v)
+	default:
+		return false
+	}
+	return true
+}
+
+/* Evaluates an expression, returning the result as a 16 bit word */
+func (m *mic1) Eval(s string) (uint16, error) {
+	e, err := ParseExpr(s)
+	if err != nil {
+		return 0, err
+	}
+	v, err := e.Eval(m)
+	return uint16(v), err
+}
+
+type exprParser struct {
+	toks []string
+	pos  int
+}
+
+func ParseExpr(s string) (Expr, error) {
+	toks, err := exprTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("missing expression")
+	}
+	p := &exprParser{toks: toks}
+	e, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, errors.New(fmt.Sprintf("unexpected \"%s\" in expression", p.toks[p.pos]))
+	}
+	return e, nil
+}
+
+func exprTokens(s string) ([]string, error) {
+	toks := make([]string, 0)
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("|^&+-*/%~()[],", c):
+			toks = append(toks, string(c))
+			i++
+		case c == '$' || c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case c == '\'' && i+2 < len(s) && s[i+2] == '\'':
+			toks = append(toks, s[i:i+3])
+			i += 3
+		default:
+			return nil, errors.New(fmt.Sprintf("unexpected \"%c\" in expression", c))
+		}
+	}
+	return toks, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(tok string) error {
+	if p.peek() != tok {
+		if p.peek() == "" {
+			return errors.New(fmt.Sprintf("expected \"%s\" at the end of the expression", tok))
+		}
+		return errors.New(fmt.Sprintf("expected \"%s\" but found \"%s\"", tok, p.peek()))
+	}
+	p.pos++
+	return nil
+}
+
+/* Binary operators from lowest to highest precedence */
+var exprLevels = []string{"|", "^", "&", "+-", "*/%"}
+
+func (p *exprParser) binary(level int) (Expr, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for len(p.peek()) == 1 && strings.Contains(exprLevels[level], p.peek()) {
+		op := rune(p.peek()[0])
+		p.pos++
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = exprBinary{op, x, y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) unary() (Expr, error) {
+	switch p.peek() {
+	case "-", "~":
+		op := rune(p.peek()[0])
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op, x}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (Expr, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, errors.New("unexpected end of expression")
+	}
+	p.pos++
+	switch {
+	case tok == "(":
+		e, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case tok == "mem" && p.peek() == "[":
+		p.pos++
+		e, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		return exprMem{e}, p.expect("]")
+	case tok[0] == '\'':
+		return exprNum(tok[1]), nil
+	case tok[0] == '$':
+		return exprReg(tok[1:]), nil
+	case unicode.IsDigit(rune(tok[0])):
+		v, err := strconv.ParseInt(tok, 0, 32)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("bad number \"%s\"", tok))
+		}
+		return exprNum(v), nil
+	case tok[0] == '_' || tok[0] == '.' || unicode.IsLetter(rune(tok[0])):
+		return exprSym(tok), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unexpected \"%s\" in expression", tok))
+}
@@ -0,0 +1,113 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/* A machine with AC 5, SP 4090, a symbol n at 100 and a symbol named like the AC register */
+func exprMic1() *mic1 {
+	m := InitMic1()
+	m.Registers[REG_AC] = 5
+	m.Registers[REG_SP] = 4090
+	m.Memory[100] = 7
+	m.Memory[4090] = 0x1234
+	m.MemSymbols = []Symbol{{Name: "n", Val: 100}, {Name: "AC", Val: 200}}
+	return m
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want uint16
+		err  string
+	}{
+		/* precedence and associativity */
+		{"1+2*3", 7, ""},
+		{"(1+2)*3", 9, ""},
+		{"1|2&3", 3, ""},
+		{"6^3&1", 7, ""},
+		{"4|1^1", 4, ""},
+		{"10-4-3", 3, ""},
+		{"64/4/2", 8, ""},
+		{"7%4*2", 6, ""},
+		{"-2*3", 0xFFFA, ""},
+		{"~0", 0xFFFF, ""},
+		{"--1", 1, ""},
+		/* operands */
+		{"0x10+0b11+10", 29, ""},
+		{"'A'", 65, ""},
+		{"n+1", 101, ""},
+		{"AC", 200, ""},
+		{"$AC", 5, ""},
+		{"$ac+1", 6, ""},
+		{"sp", 4090, ""},
+		{"mpc", 0, ""},
+		/* memory */
+		{"mem[n]", 7, ""},
+		{"mem[SP]", 0x1234, ""},
+		{"mem[n]*2+1", 15, ""},
+		{"mem[mem[n]+93]", 7, ""},
+		{"mem[4096]", 0, "address 4096 is outside of memory"},
+		{"mem[-1]", 0, "address -1 is outside of memory"},
+		/* division by zero */
+		{"1/0", 0, "division by zero"},
+		{"5%(n-100)", 0, "division by zero"},
+		/* bad tokens and syntax */
+		{"", 0, "missing expression"},
+		{"1+", 0, "unexpected end of expression"},
+		{"(1", 0, "expected \")\" at the end of the expression"},
+		{"mem[1)", 0, "expected \"]\" but found \")\""},
+		{"1 2", 0, "unexpected \"2\" in expression"},
+		{"1 # 2", 0, "unexpected \"#\" in expression"},
+		{"0xZ", 0, "bad number \"0xZ\""},
+		{"*3", 0, "unexpected \"*\" in expression"},
+		{"foo", 0, "unknown register or symbol \"foo\""},
+		{"$n", 0, "unknown register \"n\""},
+	}
+	m := exprMic1()
+	for _, tt := range tests {
+		got, err := m.Eval(tt.expr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+		} else if got != tt.want {
+			t.Errorf("%q = %d, want %d", tt.expr, got, tt.want)
+		}
+	}
+}
+
+/* Syntax errors come from ParseExpr, before there is a machine to evaluate against */
+func TestParseExprErrors(t *testing.T) {
+	for _, s := range []string{"", "1+", "(1", "mem[1", "1 2", "a @ b", "0b2"} {
+		if _, err := ParseExpr(s); err == nil {
+			t.Errorf("%q: parsed without an error", s)
+		}
+	}
+	for _, s := range []string{"foo", "$foo", "1/0", "mem[9999]"} {
+		if _, err := ParseExpr(s); err != nil {
+			t.Errorf("%q: %v, want it to parse and fail when evaluated", s, err)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * A GDB remote serial protocol stub. Memory is exposed byte addressed and
+ * big-endian, so word n lives at address 2n. Registers are the 16 Mic-1
+ * registers followed by MAR, MBR and MPC, all 16 bits wide. PC and SP point
+ * into memory so they are given as byte addresses too.
+ */
+
+/* Upper bound on microcycles for a single macro instruction step */
+const GDB_STEP_LIMIT = 10000
+
+var gdbRegNames = []string{"pc", "ac", "sp", "ir", "tir", "zero", "one", "neg1", "amask", "smask", "a", "b", "c", "d", "e", "f", "mar", "mbr", "mpc"}
+
+type GDBStub struct {
+	Mic *mic1
+}
+
+/* A packet from the client, empty data is an interrupt request */
+type gdbPacket struct {
+	Data string
+	/* Set on the last packet when reading from the connection failed */
+	Err error
+}
+
+/* The state of one debugger connection, owned by Serve */
+type gdbSession struct {
+	*GDBStub
+	conn net.Conn
+	w    *bufio.Writer
+	/* Set atomically once the client turns acknowledgements off, the reader needs it too */
+	noAck   int32
+	packets chan gdbPacket
+	/* Closed when Serve returns so the reader doesn't wait to deliver a packet */
+	done chan struct{}
+	/* Why the connection was lost while running */
+	err error
+}
+
+/* Listens on addr and serves one debugger connection at a time */
+func (g *GDBStub) ListenAndServe(addr string) error {
+	if strings.HasPrefix(addr, ":") {
+		/* Only accept local connections unless a host is given */
+		addr = "localhost" + addr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Println("Waiting for gdb on", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		log.Println("gdb connected from", conn.RemoteAddr())
+		err = g.Serve(conn)
+		conn.Close()
+		if err != nil && err != io.EOF {
+			log.Println("gdb:", err.Error())
+		}
+		log.Println("gdb disconnected")
+	}
+}
+
+/* Handles packets from a connected debugger until it detaches */
+func (g *GDBStub) Serve(conn net.Conn) error {
+	s := &gdbSession{GDBStub: g, conn: conn, w: bufio.NewWriter(conn), packets: make(chan gdbPacket), done: make(chan struct{})}
+	defer close(s.done)
+	go s.readPackets(bufio.NewReader(conn))
+
+	for {
+		pkt := <-s.packets
+		if pkt.Err != nil {
+			return pkt.Err
+		}
+		if pkt.Data == "" {
+			/* interrupt while already halted */
+			if err := s.send("S02"); err != nil {
+				return err
+			}
+			continue
+		}
+		reply, done := s.handle(pkt.Data)
+		if s.err != nil {
+			return s.err
+		}
+		if reply != nil {
+			if err := s.send(*reply); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+/* Reads packets until the connection fails, the last one delivered has the error */
+func (s *gdbSession) readPackets(r *bufio.Reader) {
+	for {
+		pkt, err := s.readPacket(r)
+		if err != nil {
+			s.deliver(gdbPacket{Err: err})
+			return
+		}
+		if pkt != nil && !s.deliver(*pkt) {
+			return
+		}
+	}
+}
+
+/* Reads the next interrupt or packet, returning nil for anything else */
+func (s *gdbSession) readPacket(r *bufio.Reader) (*gdbPacket, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case 0x03:
+		return &gdbPacket{}, nil
+	case '$':
+		data, err := r.ReadBytes('#')
+		if err != nil {
+			return nil, err
+		}
+		data = data[:len(data)-1]
+		cs := make([]byte, 2)
+		if _, err := io.ReadFull(r, cs); err != nil {
+			return nil, err
+		}
+		noAck := atomic.LoadInt32(&s.noAck) != 0
+		sum, _ := strconv.ParseUint(string(cs), 16, 8)
+		if byte(sum) != gdbChecksum(data) && !noAck {
+			s.conn.Write([]byte("-"))
+			return nil, nil
+		}
+		if !noAck {
+			s.conn.Write([]byte("+"))
+		}
+		return &gdbPacket{Data: string(gdbUnescape(data))}, nil
+	}
+	return nil, nil
+}
+
+/* Passes a packet to Serve, returning false once it has finished */
+func (s *gdbSession) deliver(pkt gdbPacket) bool {
+	select {
+	case s.packets <- pkt:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func gdbChecksum(data []byte) byte {
+	var sum byte
+	for _, c := range data {
+		sum += c
+	}
+	return sum
+}
+
+func gdbUnescape(data []byte) []byte {
+	ret := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			ret = append(ret, data[i]^0x20)
+		} else {
+			ret = append(ret, data[i])
+		}
+	}
+	return ret
+}
+
+func gdbEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '#', '$', '}', '*':
+			b.WriteByte('}')
+			b.WriteByte(s[i] ^ 0x20)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func (s *gdbSession) send(pkt string) error {
+	pkt = gdbEscape(pkt)
+	fmt.Fprintf(s.w, "$%s#%02x", pkt, gdbChecksum([]byte(pkt)))
+	return s.w.Flush()
+}
+
+func gdbReply(s string) *string {
+	return &s
+}
+
+/* Returns the reply to a packet, nil for no reply, and whether the session is over */
+func (s *gdbSession) handle(pkt string) (*string, bool) {
+	switch pkt[0] {
+	case '?':
+		return gdbReply("S05"), false
+	case 'q':
+		return gdbReply(s.query(pkt)), false
+	case 'Q':
+		if pkt == "QStartNoAckMode" {
+			atomic.StoreInt32(&s.noAck, 1)
+			return gdbReply("OK"), false
+		}
+		return gdbReply(""), false
+	case 'H', 'T':
+		return gdbReply("OK"), false
+	case 'g':
+		return gdbReply(s.readRegisters()), false
+	case 'G':
+		return gdbReply(s.writeRegisters(pkt[1:])), false
+	case 'p':
+		n, err := strconv.ParseUint(pkt[1:], 16, 8)
+		if err != nil || int(n) >= len(gdbRegNames) {
+			return gdbReply("E01"), false
+		}
+		return gdbReply(fmt.Sprintf("%04x", s.register(int(n)))), false
+	case 'P':
+		return gdbReply(s.writeRegister(pkt[1:])), false
+	case 'm':
+		return gdbReply(s.readMemory(pkt[1:])), false
+	case 'M':
+		return gdbReply(s.writeMemory(pkt[1:])), false
+	case 's':
+		err := s.Mic.StepInstruction(GDB_STEP_LIMIT)
+		s.flushOutput()
+		if err != nil {
+			/* SIGILL, no microinstruction to execute */
+			return gdbReply("S04"), false
+		}
+		return gdbReply("S05"), false
+	case 'c':
+		return gdbReply(s.cont()), false
+	case 'Z', 'z':
+		return gdbReply(s.breakpoint(pkt)), false
+	case 'D':
+		return gdbReply("OK"), true
+	case 'k':
+		return nil, true
+	}
+	return gdbReply(""), false
+}
+
+func (s *gdbSession) query(pkt string) string {
+	switch {
+	case strings.HasPrefix(pkt, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+"
+	case strings.HasPrefix(pkt, "qXfer:features:read:target.xml:"):
+		var off, length int
+		fmt.Sscanf(strings.TrimPrefix(pkt, "qXfer:features:read:target.xml:"), "%x,%x", &off, &length)
+		xml := gdbTargetXML()
+		if off >= len(xml) {
+			return "l"
+		}
+		if off+length >= len(xml) {
+			return "l" + xml[off:]
+		}
+		return "m" + xml[off:off+length]
+	case pkt == "qAttached":
+		return "1"
+	case pkt == "qC":
+		return "QC1"
+	case pkt == "qfThreadInfo":
+		return "m1"
+	case pkt == "qsThreadInfo":
+		return "l"
+	case strings.HasPrefix(pkt, "qRcmd,"):
+		return s.monitor(pkt[6:])
+	}
+	return ""
+}
+
+/* Handles "monitor" commands */
+func (s *gdbSession) monitor(arg string) string {
+	cmd, err := hex.DecodeString(arg)
+	if err != nil {
+		return "E01"
+	}
+	out := ""
+	switch strings.TrimSpace(string(cmd)) {
+	case "ustep":
+		err := s.Mic.Step()
+		s.flushOutput()
+		out = fmt.Sprintf("MPC %d\n", s.Mic.MPC)
+		if err != nil {
+			out = fmt.Sprintf("Error: %s\n", err)
+		}
+	case "reset":
+		s.Mic.Reset()
+		out = "reset\n"
+	default:
+		out = "monitor commands: ustep, reset\n"
+	}
+	return hex.EncodeToString([]byte(out))
+}
+
+func gdbTargetXML() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?><!DOCTYPE target SYSTEM "gdb-target.dtd"><target version="1.0"><feature name="org.mic1.core">`)
+	for i, n := range gdbRegNames {
+		typ := "uint16"
+		switch n {
+		case "pc":
+			typ = "code_ptr"
+		case "sp":
+			typ = "data_ptr"
+		}
+		fmt.Fprintf(&b, `<reg name="%s" bitsize="16" regnum="%d" type="%s" group="general"/>`, n, i, typ)
+	}
+	b.WriteString(`</feature></target>`)
+	return b.String()
+}
+
+func (g *GDBStub) register(n int) uint16 {
+	g.Mic.RegistersLock.Lock()
+	defer g.Mic.RegistersLock.Unlock()
+	switch {
+	case n == REG_PC || n == REG_SP:
+		return g.Mic.Registers[n] << 1
+	case n < len(g.Mic.Registers):
+		return g.Mic.Registers[n]
+	case n == 16:
+		return g.Mic.MAR
+	case n == 17:
+		return g.Mic.MBR
+	}
+	return uint16(g.Mic.MPC)
+}
+
+func (g *GDBStub) setRegister(n int, v uint16) {
+	g.Mic.RegistersLock.Lock()
+	defer g.Mic.RegistersLock.Unlock()
+	switch {
+	case n == REG_PC || n == REG_SP:
+		g.Mic.Registers[n] = v >> 1
+	case n < len(g.Mic.Registers):
+		g.Mic.Registers[n] = v
+	case n == 16:
+		g.Mic.MAR = v
+	case n == 17:
+		g.Mic.MBR = v
+	default:
+		g.Mic.MPC = uint8(v)
+	}
+}
+
+func (g *GDBStub) readRegisters() string {
+	var b strings.Builder
+	for i := range gdbRegNames {
+		fmt.Fprintf(&b, "%04x", g.register(i))
+	}
+	return b.String()
+}
+
+func (g *GDBStub) writeRegisters(data string) string {
+	if len(data) != len(gdbRegNames)*4 {
+		return "E01"
+	}
+	for i := range gdbRegNames {
+		v, err := strconv.ParseUint(data[i*4:i*4+4], 16, 16)
+		if err != nil {
+			return "E01"
+		}
+		g.setRegister(i, uint16(v))
+	}
+	return "OK"
+}
+
+func (g *GDBStub) writeRegister(arg string) string {
+	ss := strings.SplitN(arg, "=", 2)
+	if len(ss) != 2 {
+		return "E01"
+	}
+	n, err := strconv.ParseUint(ss[0], 16, 8)
+	if err != nil || int(n) >= len(gdbRegNames) {
+		return "E01"
+	}
+	v, err := strconv.ParseUint(ss[1], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	g.setRegister(int(n), uint16(v))
+	return "OK"
+}
+
+/* Parses an "addr,length" pair that must fall within max bytes */
+func gdbRange(arg string, max int) (int, int, error) {
+	ss := strings.SplitN(arg, ",", 2)
+	if len(ss) != 2 {
+		return 0, 0, errors.New("bad range")
+	}
+	addr, err := strconv.ParseUint(ss[0], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := strconv.ParseUint(ss[1], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if addr+length > uint64(max) {
+		return 0, 0, errors.New("out of range")
+	}
+	return int(addr), int(length), nil
+}
+
+func (g *GDBStub) readMemory(arg string) string {
+	addr, length, err := gdbRange(arg, len(g.Mic.Memory)*2)
+	if err != nil {
+		return "E01"
+	}
+	g.Mic.RegistersLock.Lock()
+	defer g.Mic.RegistersLock.Unlock()
+	buf := make([]byte, length)
+	for i := range buf {
+		w := g.Mic.Memory[(addr+i)/2]
+		if (addr+i)%2 == 0 {
+			buf[i] = byte(w >> 8)
+		} else {
+			buf[i] = byte(w)
+		}
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (g *GDBStub) writeMemory(arg string) string {
+	ss := strings.SplitN(arg, ":", 2)
+	if len(ss) != 2 {
+		return "E01"
+	}
+	addr, length, err := gdbRange(ss[0], len(g.Mic.Memory)*2)
+	if err != nil {
+		return "E01"
+	}
+	buf, err := hex.DecodeString(ss[1])
+	if err != nil || len(buf) != length {
+		return "E01"
+	}
+	g.Mic.RegistersLock.Lock()
+	defer g.Mic.RegistersLock.Unlock()
+	for i, b := range buf {
+		w := &g.Mic.Memory[(addr+i)/2]
+		if (addr+i)%2 == 0 {
+			*w = *w&0x00FF | uint16(b)<<8
+		} else {
+			*w = *w&0xFF00 | uint16(b)
+		}
+	}
+	return "OK"
+}
+
+/* Z0/Z1 set and z0/z1 clear a breakpoint on a macro instruction */
+func (g *GDBStub) breakpoint(pkt string) string {
+	ss := strings.Split(pkt[1:], ",")
+	if len(ss) < 2 || (ss[0] != "0" && ss[0] != "1") {
+		return ""
+	}
+	addr, err := strconv.ParseUint(ss[1], 16, 32)
+	if err != nil || addr >= uint64(len(g.Mic.Memory)*2) {
+		return "E01"
+	}
+	if pkt[0] == 'Z' {
+		g.Mic.AddPCBR(uint16(addr / 2))
+	} else {
+		g.Mic.RemovePCBR(uint16(addr / 2))
+	}
+	return "OK"
+}
+
+/* Runs until the machine halts or the debugger interrupts it */
+func (s *gdbSession) cont() string {
+	reason := "S05"
+	finished, err := s.Mic.Start(context.Background(), nil)
+	if err != nil {
+		return "E01"
+	}
+	packets := s.packets
+	/* a serial backend owns the serial port */
+	output := s.Mic.Output
+	if s.Mic.SerialExternal {
+		output = nil
+	}
+	for {
+		select {
+		case <-finished:
+			s.flushOutput()
+			if s.Mic.Fault != nil {
+				reason = "S04"
+			} else if s.Mic.MPC == 0 && s.Mic.IsPCBR(s.Mic.Registers[REG_PC]) {
+				reason = "T05swbreak:;"
+			}
+			return reason
+		case out := <-output:
+			s.send("O" + hex.EncodeToString([]byte(out)))
+		case pkt := <-packets:
+			if pkt.Err != nil {
+				/* lost the debugger, stop the machine and wait for it */
+				s.err = pkt.Err
+				s.Mic.Halt()
+				packets = nil
+			} else if pkt.Data == "" {
+				reason = "S02"
+				s.Mic.Halt()
+			}
+		}
+	}
+}
+
+/* Forwards serial output to the debugger console */
+func (s *gdbSession) flushOutput() {
+	if s.Mic.SerialExternal {
+		return
+	}
+	for {
+		select {
+		case out := <-s.Mic.Output:
+			s.send("O" + hex.EncodeToString([]byte(out)))
+		default:
+			return
+		}
+	}
+}
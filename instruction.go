@@ -35,6 +35,11 @@ type instruction struct {
 	A    int8
 	ADDR uint8
 	BR   bool
+	/* From microcode labels, see mclabels.go */
+	Label   string
+	Comment string
+	/* Label of ADDR, shown instead of the number */
+	Target string
 }
 
 /* Unpacks an binary instruction into an instruction struct */
@@ -58,6 +63,26 @@ func Unpack(ins uint32) instruction {
 	return ret
 }
 
+/* Packs an instruction struct back into its binary form */
+func (i *instruction) Pack() uint32 {
+	var ret uint32
+	ret |= uint32(i.AMUX&1) << 31
+	ret |= uint32(i.COND&3) << 29
+	ret |= uint32(i.ALU&3) << 27
+	ret |= uint32(i.SH&3) << 25
+	ret |= uint32(i.MBR&1) << 24
+	ret |= uint32(i.MAR&1) << 23
+	ret |= uint32(i.RD&1) << 22
+	ret |= uint32(i.WR&1) << 21
+	ret |= uint32(i.ENC&1) << 20
+	ret |= uint32(i.C&0xF) << 16
+	ret |= uint32(i.B&0xF) << 12
+	ret |= uint32(i.A&0xF) << 8
+	ret |= uint32(i.ADDR)
+
+	return ret
+}
+
 /* Returns a human readable format of the microcode */
 func (i *instruction) ToString() string {
 	s := ""
@@ -65,6 +90,9 @@ func (i *instruction) ToString() string {
 	breg := RegIdToNames[i.B]
 	creg := RegIdToNames[i.C]
 	addr := fmt.Sprintf("%d", i.ADDR)
+	if i.Target != "" {
+		addr = i.Target
+	}
 
 	/* Check if A bus is MBR */
 	if i.AMUX == 1 {
@@ -132,5 +160,8 @@ func (i *instruction) ToString() string {
 		s += "goto " + addr + "; "
 	}
 
+	if i.Comment != "" {
+		s += " ; " + i.Comment
+	}
 	return s
 }
@@ -0,0 +1,494 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * Keymap files bind TUI actions to keys. Each line is
+ *   view action key [key...]
+ * where view is global, registers, symbols, microcode, memory, source or
+ * watches, and more than one key makes a chord that is typed in sequence. A
+ * file replaces the default keys of every view and action it mentions, a key
+ * of none just removes them. Blank lines and lines starting with # are ignored.
+ */
+
+type KeyPress struct {
+	Key interface{}
+	Mod gocui.Modifier
+}
+
+type KeyMapping struct {
+	View   string
+	Action string
+	Keys   []KeyPress
+	/* Where the mapping came from, for error messages */
+	Source string
+}
+
+var KeyViews = []string{"global", "registers", "symbols", "microcode", "memory", "source", "watches"}
+
+/* The views each action works in, global actions work in every view */
+var KeyActions = map[string][]string{
+	"quit":              {"global"},
+	"step":              {"global"},
+	"step-line":         {"global"},
+	"step-instruction":  {"global"},
+	"step-over":         {"global"},
+	"step-out":          {"global"},
+	"run":               {"global"},
+	"halt":              {"global"},
+	"reset":             {"global"},
+	"next-view":         {"global"},
+	"changes":           {"global"},
+	"animate":           {"global"},
+	"faster":            {"global"},
+	"slower":            {"global"},
+	"prev-view":         {"global"},
+	"scroll-down":       {"registers", "symbols", "microcode", "memory", "source", "watches"},
+	"scroll-up":         {"registers", "symbols", "microcode", "memory", "source", "watches"},
+	"toggle-mode":       {"symbols", "memory", "watches"},
+	"goto":              {"symbols", "memory"},
+	"edit":              {"registers", "memory", "watches"},
+	"add":               {"watches"},
+	"delete":            {"watches"},
+	"toggle-breakpoint": {"microcode", "source"},
+	"follow":            {"microcode", "memory", "source"},
+	"left":              {"memory"},
+	"right":             {"memory"},
+	"fill":              {"memory"},
+	"copy":              {"memory"},
+	"search":            {"memory"},
+	"search-next":       {"memory"},
+	"search-prev":       {"memory"},
+	"run-to":            {"memory", "source"},
+}
+
+const DefaultKeyMap = `
+global quit ctrl+c
+global quit q
+global step s
+global step-line L
+global step-instruction i
+global step-over o
+global step-out O
+global run r
+global halt h
+global next-view c
+global prev-view C
+global reset l
+global changes d
+global animate A
+global faster +
+global slower -
+registers scroll-down j
+registers scroll-up k
+registers edit e
+registers edit enter
+symbols scroll-down j
+symbols scroll-up k
+symbols goto g
+symbols goto enter
+symbols toggle-mode m
+microcode scroll-down j
+microcode scroll-up k
+microcode toggle-breakpoint b
+microcode follow f
+memory scroll-down j
+memory scroll-up k
+memory toggle-mode m
+memory left left
+memory right right
+memory edit e
+memory edit enter
+memory fill f
+memory copy y
+memory goto g
+memory search /
+memory search-next n
+memory search-prev N
+memory follow F
+memory run-to t
+source scroll-down j
+source scroll-up k
+source toggle-breakpoint b
+source follow f
+source run-to t
+watches scroll-down j
+watches scroll-up k
+watches add a
+watches edit e
+watches edit enter
+watches delete x
+watches toggle-mode m
+`
+
+var keyNames = map[string]gocui.Key{
+	"enter":     gocui.KeyEnter,
+	"esc":       gocui.KeyEsc,
+	"tab":       gocui.KeyTab,
+	"space":     gocui.KeySpace,
+	"backspace": gocui.KeyBackspace2,
+	"delete":    gocui.KeyDelete,
+	"insert":    gocui.KeyInsert,
+	"home":      gocui.KeyHome,
+	"end":       gocui.KeyEnd,
+	"pgup":      gocui.KeyPgup,
+	"pgdn":      gocui.KeyPgdn,
+	"up":        gocui.KeyArrowUp,
+	"down":      gocui.KeyArrowDown,
+	"left":      gocui.KeyArrowLeft,
+	"right":     gocui.KeyArrowRight,
+	"f1":        gocui.KeyF1,
+	"f2":        gocui.KeyF2,
+	"f3":        gocui.KeyF3,
+	"f4":        gocui.KeyF4,
+	"f5":        gocui.KeyF5,
+	"f6":        gocui.KeyF6,
+	"f7":        gocui.KeyF7,
+	"f8":        gocui.KeyF8,
+	"f9":        gocui.KeyF9,
+	"f10":       gocui.KeyF10,
+	"f11":       gocui.KeyF11,
+	"f12":       gocui.KeyF12,
+}
+
+/* Parses a key name: a single character, ctrl+letter or one of keyNames */
+func ParseKey(s string) (KeyPress, error) {
+	if len([]rune(s)) == 1 {
+		return KeyPress{[]rune(s)[0], gocui.ModNone}, nil
+	}
+	name := strings.ToLower(s)
+	if k, ok := keyNames[name]; ok {
+		return KeyPress{k, gocui.ModNone}, nil
+	}
+	if strings.HasPrefix(name, "ctrl+") && len(name) == 6 && name[5] >= 'a' && name[5] <= 'z' {
+		return KeyPress{gocui.Key(name[5] - 'a' + 1), gocui.ModNone}, nil
+	}
+	return KeyPress{}, errors.New(fmt.Sprintf("unknown key \"%s\"", s))
+}
+
+func (k KeyPress) String() string {
+	if r, ok := k.Key.(rune); ok {
+		return string(r)
+	}
+	key := k.Key.(gocui.Key)
+	for n, v := range keyNames {
+		if v == key {
+			return n
+		}
+	}
+	if key >= 1 && key <= 26 {
+		return fmt.Sprintf("ctrl+%c", 'a'+key-1)
+	}
+	return fmt.Sprintf("key %d", key)
+}
+
+func keysString(keys []KeyPress) string {
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = k.String()
+	}
+	return strings.Join(s, " ")
+}
+
+/* Reports whether a starts with all of b */
+func keysPrefix(a []KeyPress, b []KeyPress) bool {
+	if len(b) > len(a) {
+		return false
+	}
+	for i := range b {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func validKeyView(view string, action string) bool {
+	for _, v := range KeyActions[action] {
+		if v == "global" || v == view {
+			return true
+		}
+	}
+	return false
+}
+
+/* Parses keymap lines, name is only used in errors */
+func ParseKeyMap(r io.Reader, name string) ([]KeyMapping, error) {
+	ret := make([]KeyMapping, 0)
+	errs := make([]string, 0)
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		src := fmt.Sprintf("%s:%d", name, line)
+		if len(f) < 3 {
+			errs = append(errs, fmt.Sprintf("%s: expected view action key", src))
+			continue
+		}
+		km := KeyMapping{View: f[0], Action: f[1], Source: src}
+		if _, ok := KeyActions[km.Action]; !ok {
+			errs = append(errs, fmt.Sprintf("%s: unknown action \"%s\"", src, km.Action))
+			continue
+		}
+		known := false
+		for _, v := range KeyViews {
+			known = known || v == km.View
+		}
+		if !known {
+			errs = append(errs, fmt.Sprintf("%s: unknown view \"%s\", use %s", src, km.View, strings.Join(KeyViews, ", ")))
+			continue
+		}
+		if !validKeyView(km.View, km.Action) {
+			errs = append(errs, fmt.Sprintf("%s: %s only works in %s", src, km.Action, strings.Join(KeyActions[km.Action], ", ")))
+			continue
+		}
+		if len(f) == 3 && f[2] == "none" {
+			ret = append(ret, km)
+			continue
+		}
+		for _, k := range f[2:] {
+			p, err := ParseKey(k)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", src, err.Error()))
+				km.Keys = nil
+				break
+			}
+			km.Keys = append(km.Keys, p)
+		}
+		if km.Keys != nil {
+			ret = append(ret, km)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return ret, err
+	}
+	if len(errs) > 0 {
+		return ret, errors.New(strings.Join(errs, "\n"))
+	}
+	return ret, nil
+}
+
+/*
+ * Merges mappings over base, replacing every view and action they mention,
+ * then checks that no key or chord is bound twice in a view and that no
+ * chord starts with a key that is bound on its own.
+ */
+func MergeKeyMap(base []KeyMapping, over []KeyMapping) ([]KeyMapping, error) {
+	replaced := make(map[string]bool)
+	for _, k := range over {
+		replaced[k.View+" "+k.Action] = true
+	}
+	ret := make([]KeyMapping, 0, len(base)+len(over))
+	for _, k := range base {
+		if !replaced[k.View+" "+k.Action] {
+			ret = append(ret, k)
+		}
+	}
+	for _, k := range over {
+		if k.Keys != nil {
+			ret = append(ret, k)
+		}
+	}
+	errs := make([]string, 0)
+	for i, a := range ret {
+		for _, b := range ret[i+1:] {
+			if a.View != b.View {
+				continue
+			}
+			if keysPrefix(a.Keys, b.Keys) || keysPrefix(b.Keys, a.Keys) {
+				if a.Action == b.Action && len(a.Keys) == len(b.Keys) {
+					continue
+				}
+				errs = append(errs, fmt.Sprintf("%s: \"%s\" in %s conflicts with \"%s\" for %s at %s", b.Source, keysString(b.Keys), b.View, keysString(a.Keys), a.Action, a.Source))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return ret, errors.New(strings.Join(errs, "\n"))
+	}
+	return ret, nil
+}
+
+/* Loads a keymap file over the default keys, an empty name gives the defaults */
+func LoadKeyMap(fp string) ([]KeyMapping, error) {
+	base, err := ParseKeyMap(strings.NewReader(DefaultKeyMap), "default keymap")
+	if err != nil {
+		return nil, err
+	}
+	if fp == "" {
+		return MergeKeyMap(base, nil)
+	}
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	over, err := ParseKeyMap(file, fp)
+	if err != nil {
+		return nil, err
+	}
+	return MergeKeyMap(base, over)
+}
+
+/* Returns the handler for an action in a view */
+func (u *TUI) keyHandler(view string, action string) func(*gocui.Gui, *gocui.View) error {
+	switch action {
+	case "quit":
+		return quit
+	case "step":
+		return u.MicStep
+	case "step-line":
+		return u.MicStepLine
+	case "step-instruction":
+		return u.MicStepInstruction
+	case "step-over":
+		return u.MicStepOver
+	case "step-out":
+		return u.MicStepOut
+	case "run":
+		return u.MicRun
+	case "halt":
+		return u.MicHalt
+	case "reset":
+		return u.MicReset
+	case "next-view":
+		return u.CycleView
+	case "prev-view":
+		return u.ReverseCycleView
+	case "changes":
+		return u.ChangesToggle
+	case "animate":
+		return u.MicAnimate
+	case "faster":
+		return u.ClockFaster
+	case "slower":
+		return u.ClockSlower
+	}
+	var handlers map[string]func(*gocui.Gui, *gocui.View) error
+	switch action {
+	case "scroll-down":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"registers": u.RegScrollDown, "symbols": u.SymScrollDown, "microcode": u.MicrocodeScrollDown, "memory": u.MemScrollDown, "source": u.SourceScrollDown, "watches": u.WatchScrollDown}
+	case "scroll-up":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"registers": u.RegScrollUp, "symbols": u.SymScrollUp, "microcode": u.MicrocodeScrollUp, "memory": u.MemScrollUp, "source": u.SourceScrollUp, "watches": u.WatchScrollUp}
+	case "toggle-mode":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"symbols": u.SymModeToggle, "memory": u.MemModeToggle, "watches": u.WatchModeToggle}
+	case "goto":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"symbols": u.SymGoto, "memory": u.MemGoto}
+	case "edit":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"registers": u.RegEdit, "memory": u.MemEdit, "watches": u.WatchEdit}
+	case "add":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"watches": u.WatchAdd}
+	case "delete":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"watches": u.WatchDelete}
+	case "toggle-breakpoint":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"microcode": u.MicrocodeToggleBreakPoint, "source": u.SourceToggleBreakPoint}
+	case "follow":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"microcode": u.MicrocodeFollowToggle, "memory": u.MemFollowToggle, "source": u.SourceFollowToggle}
+	case "left":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemLeft}
+	case "right":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemRight}
+	case "fill":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemFill}
+	case "copy":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemCopy}
+	case "search":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemSearch}
+	case "search-next":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemSearchNext}
+	case "search-prev":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemSearchPrev}
+	case "run-to":
+		handlers = map[string]func(*gocui.Gui, *gocui.View) error{"memory": u.MemRunTo, "source": u.SourceRunTo}
+	}
+	return handlers[view]
+}
+
+/*
+ * Handles one key press. Chords are collected in u.Chord until they match a
+ * mapping in the current view or, failing that, a global one. While the
+ * prompt is open the key goes to it instead.
+ */
+func (u *TUI) dispatchKey(p KeyPress) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if v != nil && v.Editable {
+			if r, ok := p.Key.(rune); ok {
+				v.EditWrite(r)
+			} else if p.Key != gocui.KeyEnter && p.Key != gocui.KeyEsc {
+				v.Editor.Edit(v, p.Key.(gocui.Key), 0, p.Mod)
+			}
+			return nil
+		}
+		view := ""
+		if v != nil {
+			view = v.Name()
+		}
+		seq := append(append([]KeyPress{}, u.Chord...), p)
+		u.Chord = nil
+		for _, scope := range []string{view, "global"} {
+			for _, k := range u.Keys {
+				if k.View != scope || !keysPrefix(k.Keys, seq) {
+					continue
+				}
+				if len(k.Keys) > len(seq) {
+					u.Chord = seq
+					return nil
+				}
+				h := u.keyHandler(view, k.Action)
+				if h == nil {
+					return nil
+				}
+				return h(g, v)
+			}
+		}
+		/* a key that breaks a chord starts a new one */
+		if len(seq) > 1 {
+			return u.dispatchKey(p)(g, v)
+		}
+		return nil
+	}
+}
+
+/* Registers one dispatcher for every key used in the keymap */
+func (u *TUI) bindKeys() error {
+	seen := make(map[KeyPress]bool)
+	for _, k := range u.Keys {
+		for _, p := range k.Keys {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			if err := u.Gui.SetKeybinding("", p.Key, p.Mod, u.dispatchKey(p)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
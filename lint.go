@@ -0,0 +1,186 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/* Memory interface states tracked by the linter, used as a bit set */
+const (
+	LINT_IDLE = 1 << iota
+	LINT_RD
+	LINT_WR
+)
+
+type LintIssue struct {
+	Addr uint8
+	Msg  string
+}
+
+/* Returns true if the register can not be written by microcode */
+func IsConstReg(r int8) bool {
+	switch r {
+	case REG_0, REG_1, REG_NEG1, REG_AMASK, REG_SMASK:
+		return true
+	}
+	return false
+}
+
+/* Returns the addresses the microsequencer can move to after executing the instruction at addr */
+func (m *mic1) Successors(addr uint8) []uint8 {
+	ins := m.MCC[addr]
+	if ins == nil || (ins.RD == 1 && ins.WR == 1) {
+		return nil
+	}
+	ret := make([]uint8, 0, 2)
+	if ins.COND != 3 {
+		ret = append(ret, addr+1)
+	}
+	if ins.COND != 0 && (ins.COND == 3 || ins.ADDR != addr+1) {
+		ret = append(ret, ins.ADDR)
+	}
+	return ret
+}
+
+/* Statically analyzes the loaded microcode and returns the problems found, ordered by address */
+func (m *mic1) Lint() []LintIssue {
+	issues := make([]LintIssue, 0)
+	seen := make(map[string]bool)
+	report := func(addr uint8, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		key := fmt.Sprintf("%d:%s", addr, msg)
+		if !seen[key] {
+			seen[key] = true
+			issues = append(issues, LintIssue{Addr: addr, Msg: msg})
+		}
+	}
+
+	if m.MCC[0] == nil {
+		report(0, "no microcode instruction at the reset address")
+		return issues
+	}
+
+	/* Walk every path from the reset address tracking the MAR staging state */
+	var states [256]int
+	states[0] = LINT_IDLE
+	work := []uint8{0}
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		ins := m.MCC[addr]
+		out := 0
+		for _, s := range []int{LINT_IDLE, LINT_RD, LINT_WR} {
+			if states[addr]&s == 0 {
+				continue
+			}
+			switch {
+			case ins.RD == 1 && ins.WR == 1:
+				/* halt */
+			case ins.RD == 1:
+				switch s {
+				case LINT_IDLE:
+					out |= LINT_RD
+				case LINT_RD:
+					out |= LINT_IDLE
+				case LINT_WR:
+					report(addr, "rd completes a pending wr")
+					out |= LINT_IDLE
+				}
+			case ins.WR == 1:
+				switch s {
+				case LINT_IDLE:
+					out |= LINT_WR
+				case LINT_WR:
+					out |= LINT_IDLE
+				case LINT_RD:
+					report(addr, "wr completes a pending rd")
+					out |= LINT_IDLE
+				}
+			default:
+				switch s {
+				case LINT_RD:
+					report(addr, "rd is not held for two cycles")
+				case LINT_WR:
+					report(addr, "wr is not held for two cycles")
+				}
+				/* Only report the first cycle of a broken sequence */
+				out |= LINT_IDLE
+			}
+		}
+		for _, next := range m.Successors(addr) {
+			if m.MCC[next] == nil {
+				if ins.COND != 0 && next == ins.ADDR {
+					report(addr, "jumps to empty slot %d", next)
+				} else {
+					report(addr, "falls through to empty slot %d", next)
+				}
+				continue
+			}
+			if states[next]|out != states[next] {
+				states[next] |= out
+				work = append(work, next)
+			}
+		}
+	}
+
+	for i, ins := range m.MCC {
+		if ins == nil {
+			continue
+		}
+		addr := uint8(i)
+		if states[i] == 0 {
+			report(addr, "unreachable")
+			continue
+		}
+		if ins.ENC == 1 && IsConstReg(ins.C) {
+			report(addr, "writes to constant register %s", RegIdToNames[ins.C])
+		}
+		if ins.MAR == 1 && ins.RD == 0 && ins.WR == 0 && !m.reachesMemOp(addr) {
+			report(addr, "mar is loaded but never used by rd or wr")
+		}
+	}
+
+	sort.SliceStable(issues, func(a, b int) bool {
+		return issues[a].Addr < issues[b].Addr
+	})
+	return issues
+}
+
+/* Returns true if some path from addr reaches a rd or wr before MAR is loaded again */
+func (m *mic1) reachesMemOp(addr uint8) bool {
+	var visited [256]bool
+	work := m.Successors(addr)
+	for len(work) > 0 {
+		cur := work[len(work)-1]
+		work = work[:len(work)-1]
+		ins := m.MCC[cur]
+		if visited[cur] || ins == nil {
+			continue
+		}
+		visited[cur] = true
+		if ins.RD == 1 || ins.WR == 1 {
+			return true
+		}
+		if ins.MAR == 1 {
+			continue
+		}
+		work = append(work, m.Successors(cur)...)
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+/* Microinstructions for the lint tests, jumps are unconditional */
+var (
+	lintNop     = instruction{}
+	lintMarRd   = instruction{MAR: 1, RD: 1}
+	lintMarWr   = instruction{MAR: 1, WR: 1}
+	lintHalt    = instruction{RD: 1, WR: 1}
+	lintGoto0   = instruction{COND: 3}
+	lintRdGoto0 = instruction{RD: 1, COND: 3}
+	lintWrGoto0 = instruction{WR: 1, COND: 3}
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name string
+		mc   map[uint8]instruction
+		want []string
+	}{
+		{"empty", map[uint8]instruction{}, []string{"0: no microcode instruction at the reset address"}},
+		{"rd held", map[uint8]instruction{0: lintMarRd, 1: lintRdGoto0}, nil},
+		{"wr held", map[uint8]instruction{0: lintMarWr, 1: lintWrGoto0}, nil},
+		{"rd dropped", map[uint8]instruction{0: lintMarRd, 1: lintGoto0}, []string{"1: rd is not held for two cycles"}},
+		{"wr dropped", map[uint8]instruction{0: lintMarWr, 1: lintGoto0}, []string{"1: wr is not held for two cycles"}},
+		{"wr after rd", map[uint8]instruction{0: lintMarRd, 1: lintWrGoto0}, []string{"1: wr completes a pending rd"}},
+		{"rd after wr", map[uint8]instruction{0: lintMarWr, 1: lintRdGoto0}, []string{"1: rd completes a pending wr"}},
+		{"rd on one path only", map[uint8]instruction{
+			0: {MAR: 1, RD: 1, COND: 1, ADDR: 2},
+			1: lintRdGoto0,
+			2: lintGoto0,
+		}, []string{"2: rd is not held for two cycles"}},
+		{"halt ends a path", map[uint8]instruction{0: lintMarRd, 1: {RD: 1}, 2: lintHalt}, nil},
+		{"falls off the end", map[uint8]instruction{0: lintNop}, []string{"0: falls through to empty slot 1"}},
+		{"jumps to empty", map[uint8]instruction{0: {COND: 3, ADDR: 5}}, []string{"0: jumps to empty slot 5"}},
+		{"unreachable", map[uint8]instruction{0: lintGoto0, 7: lintNop}, []string{"7: unreachable"}},
+		{"constant register", map[uint8]instruction{0: {ENC: 1, C: REG_1, COND: 3}}, []string{fmt.Sprintf("0: writes to constant register %s", RegIdToNames[REG_1])}},
+		{"unused mar", map[uint8]instruction{0: {MAR: 1, COND: 3}}, []string{"0: mar is loaded but never used by rd or wr"}},
+	}
+	for _, tt := range tests {
+		m := InitMic1()
+		for a, ins := range tt.mc {
+			ins := ins
+			m.MCC[a] = &ins
+		}
+		var got []string
+		for _, v := range m.Lint() {
+			got = append(got, fmt.Sprintf("%d: %s", v.Addr, v.Msg))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
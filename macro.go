@@ -0,0 +1,186 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/* MAC-1 macro instruction helpers */
+
+var macroOps = []string{"LODD", "STOD", "ADDD", "SUBD", "JPOS", "JZER", "JUMP", "LOCO", "LODL", "STOL", "ADDL", "SUBL", "JNEG", "JNZE", "CALL"}
+var macroStackOps = []string{"PSHI", "POPI", "PUSH", "POP", "RETN", "SWAP", "INSP", "DESP"}
+
+const (
+	MACRO_CALL = 0xE000
+	MACRO_RETN = 0xF800
+	MACRO_HALT = 0xFF00
+)
+
+func IsCall(w uint16) bool {
+	return w&0xF000 == MACRO_CALL
+}
+
+func IsRetn(w uint16) bool {
+	return w&0xFE00 == MACRO_RETN
+}
+
+/* Returns the assembly for a macro instruction, using symbol names for addresses where possible */
+func (m *mic1) Disassemble(w uint16) string {
+	op := w >> 12
+	if op < 15 {
+		arg := w & 0x0FFF
+		switch op {
+		case 7, 8, 9, 10, 11:
+			/* LOCO and the local instructions take a constant */
+			return fmt.Sprintf("%s %d", macroOps[op], arg)
+		}
+		if sym, ok := m.SymbolAt(arg); ok {
+			return fmt.Sprintf("%s %s", macroOps[op], sym.Name)
+		}
+		return fmt.Sprintf("%s %d", macroOps[op], arg)
+	}
+	if w&0xFF00 == MACRO_HALT {
+		return "HALT"
+	}
+	sop := (w >> 9) & 7
+	if sop >= 6 {
+		return fmt.Sprintf("%s %d", macroStackOps[sop], w&0x00FF)
+	}
+	return macroStackOps[sop]
+}
+
+/* Address of the macro instruction that is executing, or about to be fetched when MPC is 0 */
+func (m *mic1) CurrentPC() uint16 {
+	if m.MPC == 0 {
+		return m.Registers[REG_PC] & 0x0FFF
+	}
+	return m.InstrPC
+}
+
+/* Called when the microprogram returns to MPC 0 to track CALL and RETN */
+func (m *mic1) EndInstruction() {
+	ir := m.Registers[REG_IR]
+	if IsCall(ir) {
+		m.CallStack = append(m.CallStack, m.InstrPC)
+	} else if IsRetn(ir) && len(m.CallStack) > 0 {
+		m.CallStack = m.CallStack[:len(m.CallStack)-1]
+	}
+	m.InstrPC = m.Registers[REG_PC] & 0x0FFF
+}
+
+/* Stop condition for running one macro instruction */
+func (m *mic1) StepCond() func(m *mic1) bool {
+	return func(m *mic1) bool {
+		return true
+	}
+}
+
+/* Stop condition that runs over a CALL, until it returns to the next instruction with the same SP */
+func (m *mic1) StepOverCond() func(m *mic1) bool {
+	pc := m.CurrentPC()
+	if !IsCall(m.Memory[pc]) {
+		return m.StepCond()
+	}
+	sp := m.Registers[REG_SP]
+	return func(m *mic1) bool {
+		return m.Registers[REG_PC] == pc+1 && m.Registers[REG_SP] == sp
+	}
+}
+
+/*
+ * Stop condition that runs until the current routine executes its RETN, which
+ * leaves the call stack shallower than it was. Outside of any tracked CALL it
+ * stops at a RETN made with the call stack empty.
+ */
+func (m *mic1) StepOutCond() func(m *mic1) bool {
+	depth := len(m.CallStack)
+	prev := depth
+	return func(m *mic1) bool {
+		cur := len(m.CallStack)
+		ret := IsRetn(m.Registers[REG_IR]) && (cur < depth || depth == 0 && prev == 0)
+		prev = cur
+		return ret
+	}
+}
+
+/* Stop condition for running until the macro instruction at addr is about to be fetched */
+func (m *mic1) RunToCond(addr uint16) func(m *mic1) bool {
+	return func(m *mic1) bool {
+		return m.Registers[REG_PC]&0x0FFF == addr
+	}
+}
+
+/* Returns the value of the symbol with the given name */
+func (m *mic1) LookupSymbol(name string) (uint16, bool) {
+	for _, v := range m.MemSymbols {
+		if v.Name == name {
+			return v.Val, true
+		}
+	}
+	return 0, false
+}
+
+/* Returns the symbol at exactly addr */
+func (m *mic1) SymbolAt(addr uint16) (Symbol, bool) {
+	for _, v := range m.MemSymbols {
+		if v.Val == addr {
+			return v, true
+		}
+	}
+	return Symbol{}, false
+}
+
+/* Returns the closest symbol at or before addr, skipping symbols with a size that ends before it */
+func (m *mic1) SymbolFor(addr uint16) (Symbol, bool) {
+	best := -1
+	for i, v := range m.MemSymbols {
+		if v.Size != 0 && int(addr) >= int(v.Val)+int(v.Size) {
+			continue
+		}
+		if v.Val <= addr && (best < 0 || v.Val > m.MemSymbols[best].Val) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Symbol{}, false
+	}
+	return m.MemSymbols[best], true
+}
+
+/* Formats addr as symbol+offset when there is a symbol before it */
+func (m *mic1) AddrName(addr uint16) string {
+	sym, ok := m.SymbolFor(addr)
+	if !ok {
+		return fmt.Sprintf("%d", addr)
+	}
+	if sym.Val == addr {
+		return sym.Name
+	}
+	return fmt.Sprintf("%s+%d", sym.Name, addr-sym.Val)
+}
+
+/* Returns the symbols sorted by value */
+func (m *mic1) SortedSymbols() []Symbol {
+	ret := make([]Symbol, len(m.MemSymbols))
+	copy(ret, m.MemSymbols)
+	sort.SliceStable(ret, func(a, b int) bool {
+		return ret[a].Val < ret[b].Val
+	})
+	return ret
+}
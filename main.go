@@ -19,19 +19,46 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 )
 
 func main() {
 	mf := flag.String("mc", "", "Microcode in a binary file")
 	msf := flag.String("mcs", "", "Microcode in a binary string file")
-	memf := flag.String("m", "", "Memory in a binary file")
-	memsf := flag.String("ms", "", "Memory in a binary stirng file")
+	mcany := flag.String("microcode", "", "Microcode in any supported format, detected from the file's contents")
+	mcformat := flag.String("mcformat", "", "Read the -microcode file as the given format instead of detecting it: "+MCFormatNames())
+	memFiles := make([]MemFile, 0)
+	flag.Var(memFlag{&memFiles, "m"}, "m", "Memory in a binary file, file@base loads it at base and the flag can be repeated")
+	flag.Var(memFlag{&memFiles, "ms"}, "ms", "Memory in a binary string file, file@base loads it at base and the flag can be repeated")
+	flag.Var(memFlag{&memFiles, ""}, "mem", "Memory in any supported format, detected from the file's contents, file@base loads it at base and the flag can be repeated")
+	symFiles := make([]MemFile, 0)
+	flag.Var(memFlag{&symFiles, ""}, "sym", "Symbols in a symbol file, file@base moves them up by base and the flag can be repeated")
+	lineFiles := make([]MemFile, 0)
+	flag.Var(memFlag{&lineFiles, ""}, "lines", "Source lines in a line map file, file@base moves them up by base and the flag can be repeated")
+	memformat := flag.String("memformat", "", "Read -mem files as the given format instead of detecting it: "+MemFormatNames())
 	u := flag.Bool("u", false, "Enable CUI")
+	keys := flag.String("keys", "", "Load TUI key bindings from the given keymap file")
+	clock := flag.Int("clock", 0, "Cycles per second of the TUI's animate mode, 10 by default")
+	compat := flag.Bool("compat", false, "Use the original single letter CLI instead of the debugger commands")
+	gdb := flag.String("gdb", "", "Serve the GDB remote protocol on the given address, e.g. :1234")
+	dap := flag.String("dap", "", "Serve the Debug Adapter Protocol on stdio or the given address, e.g. :4711")
+	api := flag.String("http", "", "Serve the HTTP/JSON control API on the given address, e.g. :8080")
+	lint := flag.Bool("lint", false, "Check the microcode for common mistakes and exit")
+	ro := flag.Bool("ro", false, "Make the constant registers read-only and report writes to them")
+	rohalt := flag.Bool("rohalt", false, "Halt when microcode writes to a constant register (implies -ro)")
+	cov := flag.String("cov", "", "Write an annotated microcode coverage listing to the given file on exit")
+	covjson := flag.String("covjson", "", "Write microcode coverage as JSON to the given file on exit")
+	prof := flag.String("pprof", "", "Write a pprof profile sampled every microcycle to the given file on exit")
+	savemem := flag.String("savemem", "", "Write memory to the given file on exit, in the format named by its extension or as a hex dump")
+	savemc := flag.String("savemc", "", "Write the microcode to the given file on exit, in the format named by its extension or as binary strings")
+	trace := flag.String("trace", "", "Log every macro instruction executed with its source line to the given file")
+	config := flag.String("config", "", "Read project settings from the given JSON file instead of "+CONFIG_FILE)
+	serial := flag.String("serial", "", "Connect the serial port to stdio, null or tcp:address")
+	batchinput := flag.Bool("batchinput", false, "Check for serial input once per batch of cycles instead of every cycle")
+	bench := flag.Uint64("bench", 0, "Run the program for the given number of cycles with a Step per cycle and then in batches, print the emulated MHz of each and exit")
 
-	var mc []uint32
-	var mem []uint16
-	var syms []Symbol
 	var err error
 	var mr func(mic *mic1) error
 	var mcr func(mic *mic1) error
@@ -39,108 +66,255 @@ func main() {
 	mic := InitMic1()
 
 	flag.Parse()
+	mic.BatchInput = *batchinput
+	for i := range memFiles {
+		if memFiles[i].Format == "" {
+			memFiles[i].Format = *memformat
+		}
+	}
 
-	if *mf != "" {
-		fname := *mf
-		log.Println("Reading binary microcode file:", fname)
-		mc, err = LoadBinaryMCFile(*mf)
+	cfg, err := FindConfig(*config)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if cfg != nil {
+		if *keys == "" {
+			*keys = cfg.Path(cfg.UI.Keys)
+		}
+		if *clock == 0 {
+			*clock = cfg.UI.Clock
+		}
+		if *serial == "" {
+			*serial = cfg.Serial
+		}
+		switch cfg.UI.Mode {
+		case "tui":
+			*u = true
+		case "compat":
+			*compat = true
+		}
+	}
+
+	mic.ConstProtect = *ro || *rohalt
+	mic.ConstHalt = *rohalt
+	if *cov != "" || *covjson != "" {
+		mic.Coverage = &Coverage{}
+	}
+	if *prof != "" {
+		mic.Profiler = NewProfiler()
+		mic.Profiler.MCFile = *mf + *msf + *mcany
+		if len(memFiles) > 0 {
+			mic.Profiler.MemFile = memFiles[0].File
+		}
+		if cfg != nil && mic.Profiler.MCFile == "" {
+			mic.Profiler.MCFile = cfg.Microcode.File
+		}
+	}
+	if *trace != "" {
+		mic.Tracer, err = NewTracer(*trace)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		log.Printf("Loaded %d microcode instructions", len(mc))
-		mic.LoadMC(mc)
-		mcr = func(mic *mic1) error {
-			mc, err := LoadBinaryMCFile(fname)
-			if err != nil {
-				return err
-			}
-			mic.LoadMC(mc)
-			return nil
-		}
+	}
+
+	fname, format := *mcany, *mcformat
+	if *mf != "" {
+		fname, format = *mf, "mc"
 	} else if *msf != "" {
-		fname := *msf
-		log.Println("Reading binary string microcode file:", fname)
-		mc, err = LoadBinaryStringMCFile(fname)
+		fname, format = *msf, "mcs"
+	}
+	if fname != "" {
+		log.Println("Reading microcode file:", fname)
+		img, err := LoadMCFile(fname, format)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		log.Printf("Loaded %d microcode instructions", len(mc))
-		mic.LoadMC(mc)
+		log.Printf("Loaded %d microcode instructions", len(img.Words))
+		mic.LoadMCImage(img)
 		mcr = func(mic *mic1) error {
-			mc, err := LoadBinaryStringMCFile(fname)
+			img, err := LoadMCFile(fname, format)
 			if err != nil {
 				return err
 			}
-			mic.LoadMC(mc)
+			mic.LoadMCImage(img)
 			return nil
 		}
+	} else if cfg != nil && cfg.Microcode.File != "" {
+		mcr = cfg.LoadMicrocode
+		if err := mcr(mic); err != nil {
+			log.Fatal(err.Error())
+		}
 	} else {
 		fmt.Println("Error: no microcode file given!")
 		flag.Usage()
 		return
 	}
 
-	if *memf != "" {
-		fname := *memf
-		log.Println("Reading binary memory file:", fname)
-		mem, err = LoadBinaryMemFile(fname)
-		if err != nil {
+	if *lint {
+		issues := mic.Lint()
+		for _, v := range issues {
+			ins := ""
+			if mic.MCC[v.Addr] != nil {
+				ins = mic.MCC[v.Addr].ToString()
+			}
+			fmt.Printf("%3d: %s\n     %s\n", v.Addr, v.Msg, ins)
+		}
+		fmt.Printf("%d problems found\n", len(issues))
+		if len(issues) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(memFiles) > 0 {
+		mr = func(mic *mic1) error {
+			return LoadMemFiles(mic, memFiles)
+		}
+		if err := mr(mic); err != nil {
 			log.Fatal(err.Error())
 		}
-		syms = make([]Symbol, 0, 0)
-		log.Printf("Loaded %d memory words", len(mem))
-		log.Printf("Loaded %d memory symbols", len(syms))
-		mic.LoadMem(mem)
-		mic.MemSymbols = syms
+	} else if cfg != nil && (len(cfg.Memory) > 0 || len(cfg.Symbols) > 0 || len(cfg.Lines) > 0) {
+		mr = cfg.LoadMemory
+		if err := mr(mic); err != nil {
+			log.Fatal(err.Error())
+		}
+	} else {
+		log.Println("no memory file given!")
+	}
+	if len(symFiles) > 0 {
+		load := mr
 		mr = func(mic *mic1) error {
-			mem, err := LoadBinaryMemFile(fname)
-			syms := make([]Symbol, 0, 0)
-			if err != nil {
-				return err
+			if load != nil {
+				if err := load(mic); err != nil {
+					return err
+				}
 			}
-			mic.LoadMem(mem)
-			mic.MemSymbols = syms
-			return nil
+			return LoadSymbolFiles(mic, symFiles)
 		}
-	} else if *memsf != "" {
-		fname := *memsf
-		log.Println("Reading binary string memory file:", fname)
-		mem, syms, err = LoadBinaryStringMemFile(fname)
-		if err != nil {
+		if err := LoadSymbolFiles(mic, symFiles); err != nil {
 			log.Fatal(err.Error())
 		}
-		log.Printf("Loaded %d memory words", len(mem))
-		log.Printf("Loaded %d memory symbols", len(syms))
-		mic.LoadMem(mem)
-		mic.MemSymbols = syms
+	}
+	if len(lineFiles) > 0 {
+		load := mr
 		mr = func(mic *mic1) error {
-			mem, syms, err := LoadBinaryStringMemFile(fname)
-			if err != nil {
-				log.Print(err.Error())
-				return err
+			if load != nil {
+				if err := load(mic); err != nil {
+					return err
+				}
 			}
-			mic.LoadMem(mem)
-			mic.MemSymbols = syms
-
-			return nil
+			return LoadLineMaps(mic, lineFiles)
 		}
-	} else {
-		log.Println("no memory file given!")
+		if err := LoadLineMaps(mic, lineFiles); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if cfg != nil {
+		/* register values are set again whenever memory is reloaded */
+		load := mr
+		mr = func(mic *mic1) error {
+			if load != nil {
+				if err := load(mic); err != nil {
+					return err
+				}
+			}
+			return cfg.SetRegisters(mic)
+		}
+		if err := cfg.SetRegisters(mic); err != nil {
+			log.Fatal(err.Error())
+		}
+		if err := cfg.Apply(mic); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if *bench > 0 {
+		PrintBenchmark(mic, *bench)
+		return
 	}
-	if *u {
-		g, err := initGui(mic)
+	/* stdio leaves the serial port to the UI or debugger client */
+	if err := StartSerial(mic, *serial); err != nil {
+		log.Fatal(err.Error())
+	}
+	if *api != "" {
+		s := APIServer{Mic: mic, MR: mr, MCR: mcr}
+		if err := s.ListenAndServe(*api); err != nil {
+			log.Fatal(err.Error())
+		}
+	} else if *dap != "" {
+		s := DAPServer{Mic: mic}
+		if err := s.ListenAndServe(*dap); err != nil && err != io.EOF {
+			log.Fatal(err.Error())
+		}
+	} else if *gdb != "" {
+		s := GDBStub{Mic: mic}
+		if err := s.ListenAndServe(*gdb); err != nil {
+			log.Fatal(err.Error())
+		}
+	} else if *u {
+		km, err := LoadKeyMap(*keys)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		g, err := initGui(mic, km)
 		if err != nil {
 			log.Panicln(err)
 		}
 		g.MR = mr
 		g.MCR = mcr
+		if cfg != nil {
+			cfg.ApplyTUI(g)
+		}
+		if *clock > 0 {
+			g.ClockRate = *clock
+		}
 		err = g.Run()
 		if err != nil {
 			log.Panicln(err)
 		}
 	} else {
-		u := CLI{Mic: mic}
-		u.Run()
+		u := CLI{Mic: mic, MR: mr, MCR: mcr}
+		if *compat {
+			u.RunCompat()
+		} else {
+			u.Run()
+		}
+	}
+	mic.Halt()
+	mic.Wait()
+	if mic.Profiler != nil {
+		if err := mic.Profiler.Save(*prof, mic); err != nil {
+			log.Println(err.Error())
+		} else {
+			log.Println("Wrote profile to", *prof)
+		}
+	}
+	if mic.Coverage != nil {
+		if err := SaveCoverage(mic, *cov, *covjson); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	if *savemem != "" {
+		if _, err := SaveMemFile(*savemem, "", mic.MemImageOf(nil)); err != nil {
+			log.Println(err.Error())
+		} else {
+			log.Println("Wrote memory to", *savemem)
+		}
+	}
+	if *savemc != "" {
+		if _, err := SaveMCFile(*savemc, "", mic.MCImageOf()); err != nil {
+			log.Println(err.Error())
+		} else {
+			log.Println("Wrote microcode to", *savemc)
+		}
+	}
+	if mic.Tracer != nil {
+		/* the machine could still be finishing a cycle */
+		mic.RegistersLock.Lock()
+		if err := mic.Tracer.Close(); err != nil {
+			log.Println(err.Error())
+		}
+		mic.Tracer = nil
+		mic.RegistersLock.Unlock()
 	}
 	//log.Printf("Completed %d cycles", mic.Cycles)
 }
@@ -0,0 +1,444 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Microcode decoders. DecodeMC asks each decoder in turn whether the data
+ * looks like its format and uses the first one that says yes, so errors can
+ * say which format was assumed and why.
+ */
+
+type MCDecoder struct {
+	/* Short name used by -mcformat and config files */
+	Name string
+	Desc string
+	/* Returns why the data looks like this format, or "" when it doesn't */
+	Sniff func(buff []byte) string
+	/* name is only used in errors */
+	Decode func(buff []byte, name string) (*MCImage, error)
+	/* Writes an image in this format, see export.go */
+	Encode func(w io.Writer, img *MCImage) error
+}
+
+var MCDecoders []MCDecoder
+
+func init() {
+	MCDecoders = []MCDecoder{
+		{"mc", "binary", sniffBinary, DecodeBinaryMC, EncodeBinaryMC},
+		{"ihex", "Intel HEX", sniffIntelHex, DecodeIntelHexMC, EncodeIntelHexMC},
+		{"logisim", "Logisim ROM image", sniffLogisim, DecodeLogisimMC, EncodeLogisimMC},
+		{"listing", "listing", sniffListing, DecodeListingMC, EncodeListingMC},
+		{"mcs", "binary string", sniffBinaryString, DecodeBinaryStringMC, EncodeBinaryStringMC},
+		{"hex", "hex text", sniffHex, DecodeHexMC, EncodeHexMC},
+	}
+}
+
+func FindMCDecoder(name string) *MCDecoder {
+	for i, v := range MCDecoders {
+		if v.Name == name {
+			return &MCDecoders[i]
+		}
+	}
+	return nil
+}
+
+func MCFormatNames() string {
+	names := make([]string, len(MCDecoders))
+	for i, v := range MCDecoders {
+		names[i] = v.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+/*
+ * Decodes microcode in the given format, or the detected format when format
+ * is empty or auto.
+ */
+func DecodeMC(buff []byte, name string, format string) (*MCImage, error) {
+	var dec *MCDecoder
+	why := ""
+	if format == "" || format == "auto" {
+		for i, v := range MCDecoders {
+			if why = v.Sniff(buff); why != "" {
+				dec = &MCDecoders[i]
+				break
+			}
+		}
+		if dec == nil {
+			return nil, errors.New(fmt.Sprintf("Microcode file, \"%s\" is not in a known format (%s), the first line is \"%s\"", name, MCFormatNames(), shortLine(firstLine(buff))))
+		}
+		why = fmt.Sprintf("assumed %s because %s", dec.Desc, why)
+	} else {
+		if dec = FindMCDecoder(format); dec == nil {
+			return nil, errors.New(fmt.Sprintf("unknown microcode format \"%s\", use %s", format, MCFormatNames()))
+		}
+		why = fmt.Sprintf("read as %s", dec.Desc)
+	}
+	img, err := dec.Decode(buff, name)
+	if err == nil && len(img.Words) > 256 {
+		err = errors.New(fmt.Sprintf("%d words do not fit in the 256 word control store", len(img.Words)))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Microcode file, \"%s\" %s: %s", name, why, err.Error()))
+	}
+	return img, nil
+}
+
+/*
+ * Loads a microcode file in the given format, or the detected format when
+ * format is empty or auto, with the labels file next to it if there is one.
+ */
+func LoadMCFile(fp string, format string) (*MCImage, error) {
+	buff, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	img, err := DecodeMC(buff, fp, format)
+	if err != nil {
+		return nil, err
+	}
+	if lp := FindMCLabelFile(fp); lp != "" {
+		if err := img.LoadLabels(lp); err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded microcode labels from %s", lp)
+	}
+	return img, nil
+}
+
+/* Returns the non-blank, non-comment lines with their line numbers */
+func textLines(buff []byte) ([]string, []int) {
+	lines := make([]string, 0)
+	nums := make([]int, 0)
+	s := bufio.NewScanner(bytes.NewReader(buff))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		lines = append(lines, line)
+		nums = append(nums, n)
+	}
+	return lines, nums
+}
+
+func firstLine(buff []byte) string {
+	lines, _ := textLines(buff)
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[0]
+}
+
+/* Shortens a line for an error message */
+func shortLine(s string) string {
+	if len(s) > 40 {
+		return s[:40] + "..."
+	}
+	return s
+}
+
+func isBinaryWord(s string) bool {
+	if len(s) == 0 || len(s) > 32 {
+		return false
+	}
+	return strings.Trim(s, "01") == ""
+}
+
+/* Parses a hex word with an optional 0x */
+func parseHexWord(s string) (uint32, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("\"%s\" is not a 32 bit hex word", s))
+	}
+	return uint32(v), nil
+}
+
+func sniffBinary(buff []byte) string {
+	for _, b := range buff {
+		if (b < 0x20 || b > 0x7E) && b != '\n' && b != '\r' && b != '\t' {
+			return "it contains bytes that aren't text"
+		}
+	}
+	return ""
+}
+
+func sniffIntelHex(buff []byte) string {
+	if strings.HasPrefix(firstLine(buff), ":") {
+		return "the first line starts with ':' like an Intel HEX record"
+	}
+	return ""
+}
+
+func sniffLogisim(buff []byte) string {
+	if firstLine(buff) == "v2.0 raw" {
+		return "it starts with \"v2.0 raw\""
+	}
+	return ""
+}
+
+var listingLine = regexp.MustCompile(`^(0[xX][0-9a-fA-F]+|[0-9]+)\s*:\s*(\S.*)$`)
+
+func sniffListing(buff []byte) string {
+	if listingLine.MatchString(firstLine(buff)) {
+		return "the first line starts with an address and a colon"
+	}
+	return ""
+}
+
+func sniffBinaryString(buff []byte) string {
+	if _, l, _ := splitMCLine(firstLine(buff)); len(l) == 32 && isBinaryWord(l) {
+		return "the first line is 32 binary digits"
+	}
+	return ""
+}
+
+func sniffHex(buff []byte) string {
+	_, l, _ := splitMCLine(firstLine(buff))
+	f := strings.Fields(l)
+	if len(f) == 0 {
+		return ""
+	}
+	for _, v := range f {
+		if _, err := parseHexWord(v); err != nil {
+			return ""
+		}
+	}
+	return "the first line is hexadecimal"
+}
+
+func DecodeBinaryMC(buff []byte, name string) (*MCImage, error) {
+	if len(buff)%4 != 0 {
+		return nil, errors.New(fmt.Sprintf("%d bytes is not a multiple of 4", len(buff)))
+	}
+	mc, err := ParseBinaryMC(buff, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewMCImage(mc), nil
+}
+
+/* One 32 digit binary string per line */
+func DecodeBinaryStringMC(buff []byte, name string) (*MCImage, error) {
+	img := NewMCImage(make([]uint32, 0, 256))
+	lines, nums := textLines(buff)
+	for i, line := range lines {
+		label, body, comment := splitMCLine(line)
+		if !isBinaryWord(body) {
+			return nil, errors.New(fmt.Sprintf("line %d: \"%s\" is not a binary word", nums[i], body))
+		}
+		v, _ := strconv.ParseUint(body, 2, 32)
+		img.annotate(len(img.Words), label, comment)
+		img.Words = append(img.Words, uint32(v))
+	}
+	return img, nil
+}
+
+/* Hex words separated by white space, a label or comment belongs to the first word on its line */
+func DecodeHexMC(buff []byte, name string) (*MCImage, error) {
+	img := NewMCImage(make([]uint32, 0, 256))
+	lines, nums := textLines(buff)
+	for i, line := range lines {
+		label, body, comment := splitMCLine(line)
+		img.annotate(len(img.Words), label, comment)
+		for _, f := range strings.Fields(body) {
+			v, err := parseHexWord(f)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: %s", nums[i], err.Error()))
+			}
+			img.Words = append(img.Words, v)
+		}
+	}
+	return img, nil
+}
+
+/* Logisim "v2.0 raw" images: hex words where N*word repeats a word N times */
+func DecodeLogisimMC(buff []byte, name string) (*MCImage, error) {
+	ret := make([]uint32, 0, 256)
+	lines, nums := textLines(buff)
+	if len(lines) == 0 || lines[0] != "v2.0 raw" {
+		return nil, errors.New("missing the \"v2.0 raw\" header")
+	}
+	for i, line := range lines[1:] {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		for _, f := range strings.Fields(line) {
+			count := 1
+			if j := strings.Index(f, "*"); j >= 0 {
+				n, err := strconv.Atoi(f[:j])
+				if err != nil || n < 1 {
+					return nil, errors.New(fmt.Sprintf("line %d: bad repeat count in \"%s\"", nums[i+1], f))
+				}
+				count = n
+				f = f[j+1:]
+			}
+			v, err := parseHexWord(f)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: %s", nums[i+1], err.Error()))
+			}
+			if len(ret)+count > 256 {
+				return nil, errors.New(fmt.Sprintf("line %d: more than 256 words", nums[i+1]))
+			}
+			for ; count > 0; count-- {
+				ret = append(ret, v)
+			}
+		}
+	}
+	/* zero words are kept, they are valid microinstructions */
+	return NewMCImage(ret), nil
+}
+
+/* Intel HEX with big-endian 32 bit words starting at address 0 */
+func DecodeIntelHexMC(buff []byte, name string) (*MCImage, error) {
+	chunks, err := ParseIntelHex(buff)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, 1024)
+	for _, c := range chunks {
+		if c.Addr != uint32(len(data)) {
+			return nil, errors.New(fmt.Sprintf("line %d: data at address %#x but %#x was expected, microcode must be contiguous from 0", c.Line, c.Addr, len(data)))
+		}
+		data = append(data, c.Data...)
+	}
+	return DecodeBinaryMC(data, name)
+}
+
+/* Bytes from one record of an Intel HEX or S-record file */
+type ByteChunk struct {
+	Addr uint32
+	Data []byte
+	Line int
+}
+
+/* Returns the data records of an Intel HEX file in file order with checksums checked */
+func ParseIntelHex(buff []byte) ([]ByteChunk, error) {
+	chunks := make([]ByteChunk, 0)
+	var base uint32
+	lines, nums := textLines(buff)
+	for i, line := range lines {
+		if line[0] != ':' || len(line) < 11 || len(line)%2 != 1 {
+			return nil, errors.New(fmt.Sprintf("line %d: not an Intel HEX record", nums[i]))
+		}
+		rec, err := hexBytes(line[1:])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", nums[i], err.Error()))
+		}
+		var sum byte
+		for _, v := range rec {
+			sum += v
+		}
+		if sum != 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: bad checksum", nums[i]))
+		}
+		n := int(rec[0])
+		if len(rec) != n+5 {
+			return nil, errors.New(fmt.Sprintf("line %d: record length doesn't match its byte count", nums[i]))
+		}
+		addr := base + uint32(rec[1])<<8 + uint32(rec[2])
+		payload := rec[4 : 4+n]
+		switch rec[3] {
+		case 0x00:
+			chunks = append(chunks, ByteChunk{addr, payload, nums[i]})
+		case 0x01:
+			return chunks, nil
+		case 0x02:
+			if n != 2 {
+				return nil, errors.New(fmt.Sprintf("line %d: bad extended segment address record", nums[i]))
+			}
+			base = (uint32(payload[0])<<8 + uint32(payload[1])) << 4
+		case 0x04:
+			if n != 2 {
+				return nil, errors.New(fmt.Sprintf("line %d: bad extended linear address record", nums[i]))
+			}
+			base = (uint32(payload[0])<<8 + uint32(payload[1])) << 16
+		case 0x03, 0x05:
+			/* start addresses mean nothing to the Mic-1 */
+		default:
+			return nil, errors.New(fmt.Sprintf("line %d: unknown record type %02x", nums[i], rec[3]))
+		}
+	}
+	return chunks, nil
+}
+
+/* Decodes pairs of hex digits */
+func hexBytes(s string) ([]byte, error) {
+	ret := make([]byte, len(s)/2)
+	for j := range ret {
+		v, err := strconv.ParseUint(s[2*j:2*j+2], 16, 8)
+		if err != nil {
+			return nil, errors.New("bad hex digits")
+		}
+		ret[j] = byte(v)
+	}
+	return ret, nil
+}
+
+/*
+ * Listings with one "address: [label:] word" per line and anything after the
+ * word ignored except a ; comment. Addresses are decimal unless they start
+ * with 0x and words are 32 binary digits or hex.
+ */
+func DecodeListingMC(buff []byte, name string) (*MCImage, error) {
+	img := NewMCImage(make([]uint32, 0, 256))
+	ret := img.Words
+	lines, nums := textLines(buff)
+	for i, line := range lines {
+		f := listingLine.FindStringSubmatch(line)
+		if f == nil {
+			return nil, errors.New(fmt.Sprintf("line %d: expected address: word", nums[i]))
+		}
+		addr, err := strconv.ParseUint(f[1], 0, 16)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: bad address \"%s\"", nums[i], f[1]))
+		}
+		if int(addr) != len(ret) {
+			return nil, errors.New(fmt.Sprintf("line %d: address %d but %d was expected, microcode must be contiguous from 0", nums[i], addr, len(ret)))
+		}
+		label, body, comment := splitMCLine(f[2])
+		word := strings.Fields(body)
+		if len(word) == 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: expected address: word", nums[i]))
+		}
+		var v uint32
+		if len(word[0]) == 32 && isBinaryWord(word[0]) {
+			v64, _ := strconv.ParseUint(word[0], 2, 32)
+			v = uint32(v64)
+		} else if v, err = parseHexWord(word[0]); err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", nums[i], err.Error()))
+		}
+		img.annotate(len(ret), label, comment)
+		ret = append(ret, v)
+	}
+	img.Words = ret
+	return img, nil
+}
@@ -0,0 +1,91 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeMC(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		words  []uint32
+		err    string
+	}{
+		{"binary string", "", "00000000000000000000000000000001\n10000000000000000000000000000000\n", []uint32{1, 0x80000000}, ""},
+		{"binary string with labels and comments", "", "# fetch\nstart: 00000000000000000000000000000001 ; one\n", []uint32{1}, ""},
+		{"binary string bad digit", "mcs", "0000000000000000000000000000000x\n", nil, "line 1: \"0000000000000000000000000000000x\" is not a binary word"},
+		{"hex", "", "0x1 2\nff\n", []uint32{1, 2, 0xff}, ""},
+		{"hex bad word", "hex", "1 zz\n", nil, "line 1: \"zz\" is not a 32 bit hex word"},
+		{"hex too long", "hex", strings.Repeat("1 ", 257), nil, "257 words do not fit"},
+		{"intel hex", "", ":0400000001020304F2\n:00000001FF\n", []uint32{0x01020304}, ""},
+		{"intel hex bad checksum", "", ":0400000001020304F3\n", nil, "line 1: bad checksum"},
+		{"intel hex gap", "", ":0400040001020304EE\n", nil, "line 1: data at address 0x4 but 0x0 was expected"},
+		{"intel hex bad record", "ihex", ":04000000\n", nil, "line 1: not an Intel HEX record"},
+		{"logisim keeps trailing zeros", "", "v2.0 raw\n1 2*0\n", []uint32{1, 0, 0}, ""},
+		{"logisim too long", "logisim", "v2.0 raw\n257*1\n", nil, "line 2: more than 256 words"},
+		{"logisim bad repeat", "logisim", "v2.0 raw\n0*1\n", nil, "line 2: bad repeat count"},
+		{"listing", "", "0: 0x5\n1: 00000000000000000000000000000110\n", []uint32{5, 6}, ""},
+		{"listing gap", "", "0: 0x5\n2: 0x6\n", nil, "line 2: address 2 but 1 was expected"},
+		{"binary", "mc", "\x00\x00\x00\x01\xff\x00\x00\x00", []uint32{1, 0xff000000}, ""},
+		{"binary odd length", "mc", "\x00\x00\x01", nil, "3 bytes is not a multiple of 4"},
+		{"unknown format", "", "hello there\n", nil, "is not in a known format"},
+	}
+	for _, tt := range tests {
+		img, err := DecodeMC([]byte(tt.data), "test", tt.format)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(img.Words, tt.words) {
+			t.Errorf("%s: got %#x, want %#x", tt.name, img.Words, tt.words)
+		}
+	}
+}
+
+/* Every format reads back what it writes, both by name and when detected */
+func TestMCRoundTrip(t *testing.T) {
+	words := []uint32{0x00000001, 0xfffffffe, 0x80000000, 0, 0x12345678, 0, 0}
+	for _, dec := range MCDecoders {
+		var buff bytes.Buffer
+		if err := dec.Encode(&buff, NewMCImage(words)); err != nil {
+			t.Errorf("%s: %s", dec.Name, err)
+			continue
+		}
+		for _, format := range []string{dec.Name, "auto"} {
+			img, err := DecodeMC(buff.Bytes(), "test", format)
+			if err != nil {
+				t.Errorf("%s read as %s: %s", dec.Name, format, err)
+				continue
+			}
+			if !reflect.DeepEqual(img.Words, words) {
+				t.Errorf("%s read as %s: got %#x, want %#x", dec.Name, format, img.Words, words)
+			}
+		}
+	}
+}
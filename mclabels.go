@@ -0,0 +1,170 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Microcode labels and comments. Text microcode lines can be written as
+ *   [label:] word [; comment]
+ * and binary images can have a labels file next to them with the same name
+ * and a .mcl extension holding lines of
+ *   slot [label:] [; comment]
+ */
+
+const MC_LABEL_EXT = ".mcl"
+
+/* Decoded microcode with the labels and comments of its slots */
+type MCImage struct {
+	Words    []uint32
+	Labels   map[int]string
+	Comments map[int]string
+}
+
+func NewMCImage(words []uint32) *MCImage {
+	return &MCImage{Words: words, Labels: make(map[int]string), Comments: make(map[int]string)}
+}
+
+func (img *MCImage) annotate(slot int, label string, comment string) {
+	if label != "" {
+		img.Labels[slot] = label
+	}
+	if comment != "" {
+		img.Comments[slot] = comment
+	}
+}
+
+var mcLabel = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.]*):\s*`)
+
+/* Splits "[label:] body [; comment]" */
+func splitMCLine(line string) (string, string, string) {
+	label := ""
+	comment := ""
+	if i := strings.Index(line, ";"); i >= 0 {
+		comment = strings.TrimSpace(line[i+1:])
+		line = line[:i]
+	}
+	if f := mcLabel.FindStringSubmatch(line); f != nil {
+		label = f[1]
+		line = line[len(f[0]):]
+	}
+	return label, strings.TrimSpace(line), comment
+}
+
+/* Returns the labels file next to a microcode file, or "" when there isn't one */
+func FindMCLabelFile(fp string) string {
+	stem := fp
+	if i := strings.LastIndex(fp, "."); i > strings.LastIndex(fp, "/") {
+		stem = fp[:i]
+	}
+	for _, lp := range []string{stem + MC_LABEL_EXT, fp + MC_LABEL_EXT} {
+		if _, err := os.Stat(lp); err == nil && lp != fp {
+			return lp
+		}
+	}
+	return ""
+}
+
+/* Adds the labels and comments in a labels file, they replace ones from the microcode file */
+func (img *MCImage) LoadLabels(fp string) error {
+	file, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f := strings.Fields(line)
+		slot, err := strconv.Atoi(f[0])
+		if err != nil || slot < 0 || slot > 255 {
+			return errors.New(fmt.Sprintf("Labels file, \"%s\": line %d: bad slot \"%s\"", fp, n, f[0]))
+		}
+		label, rest, comment := splitMCLine(strings.TrimSpace(line[len(f[0]):]))
+		if rest != "" {
+			return errors.New(fmt.Sprintf("Labels file, \"%s\": line %d: expected slot label: ; comment", fp, n))
+		}
+		img.annotate(slot, label, comment)
+	}
+	return s.Err()
+}
+
+/* Loads the words into the control store and attaches their labels and comments */
+func (m *mic1) LoadMCImage(img *MCImage) {
+	m.LoadMC(img.Words)
+	for i, v := range m.MCC {
+		if v != nil {
+			v.Label = img.Labels[i]
+			v.Comment = img.Comments[i]
+		}
+	}
+	m.ResolveMCLabels()
+}
+
+/* Points each instruction's goto at the label of its target */
+func (m *mic1) ResolveMCLabels() {
+	for _, v := range m.MCC {
+		if v == nil {
+			continue
+		}
+		v.Target = ""
+		if t := m.MCC[v.ADDR]; t != nil {
+			v.Target = t.Label
+		}
+	}
+}
+
+/* Returns the slot with the given label */
+func (m *mic1) MCLabel(name string) (int, bool) {
+	for i, v := range m.MCC {
+		if v != nil && v.Label == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+/* Returns a microcode slot from a label or an expression */
+func (m *mic1) MCSlot(s string) (int, error) {
+	if i, ok := m.MCLabel(s); ok {
+		return i, nil
+	}
+	v, err := m.Eval(s)
+	if err != nil {
+		return 0, err
+	}
+	return int(v), nil
+}
+
+/* Returns the instruction with its label in front */
+func (i *instruction) LabelString() string {
+	if i.Label == "" {
+		return i.ToString()
+	}
+	return i.Label + ": " + i.ToString()
+}
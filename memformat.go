@@ -0,0 +1,429 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Memory images are made of segments loaded at their own addresses, so a
+ * program, its data tables and a library can share one memory. Decoders
+ * work like the microcode ones in mcformat.go.
+ */
+
+type MemSegment struct {
+	Base  uint16
+	Words []uint16
+}
+
+type MemImage struct {
+	Segments []MemSegment
+	Symbols  []Symbol
+}
+
+/* Number of words in every segment */
+func (img *MemImage) Len() int {
+	n := 0
+	for _, v := range img.Segments {
+		n += len(v.Words)
+	}
+	return n
+}
+
+/* Moves the segments and symbols up by base */
+func (img *MemImage) Relocate(base uint16) {
+	for i := range img.Segments {
+		img.Segments[i].Base += base
+	}
+	for i := range img.Symbols {
+		img.Symbols[i].Val += base
+	}
+}
+
+/* Copies each segment to its address, returning an error if one doesn't fit */
+func (m *mic1) LoadImage(img *MemImage) error {
+	for _, v := range img.Segments {
+		if err := m.LoadMemAt(v.Words, v.Base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type MemDecoder struct {
+	/* Short name used by -memformat and config files */
+	Name string
+	Desc string
+	/* Returns why the data looks like this format, or "" when it doesn't */
+	Sniff  func(buff []byte) string
+	Decode func(buff []byte, name string) (*MemImage, error)
+	/* Writes an image in this format, see export.go */
+	Encode func(w io.Writer, img *MemImage) error
+}
+
+var MemDecoders []MemDecoder
+
+func init() {
+	MemDecoders = []MemDecoder{
+		{"m", "binary", sniffBinary, DecodeBinaryMem, EncodeBinaryMem},
+		{"ihex", "Intel HEX", sniffIntelHex, DecodeIntelHexMem, EncodeIntelHexMem},
+		{"srec", "S-record", sniffSRecord, DecodeSRecordMem, EncodeSRecordMem},
+		{"dump", "hex dump", sniffHexDump, DecodeHexDumpMem, EncodeHexDumpMem},
+		{"ms", "binary string", sniffBinaryStringMem, DecodeBinaryStringMem, EncodeBinaryStringMem},
+	}
+}
+
+func FindMemDecoder(name string) *MemDecoder {
+	for i, v := range MemDecoders {
+		if v.Name == name {
+			return &MemDecoders[i]
+		}
+	}
+	return nil
+}
+
+func MemFormatNames() string {
+	names := make([]string, len(MemDecoders))
+	for i, v := range MemDecoders {
+		names[i] = v.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+/*
+ * Decodes a memory image in the given format, or the detected format when
+ * format is empty or auto.
+ */
+func DecodeMem(buff []byte, name string, format string) (*MemImage, error) {
+	var dec *MemDecoder
+	why := ""
+	if format == "" || format == "auto" {
+		for i, v := range MemDecoders {
+			if why = v.Sniff(buff); why != "" {
+				dec = &MemDecoders[i]
+				break
+			}
+		}
+		if dec == nil {
+			return nil, errors.New(fmt.Sprintf("Memory file, \"%s\" is not in a known format (%s), the first line is \"%s\"", name, MemFormatNames(), shortLine(firstLine(buff))))
+		}
+		why = fmt.Sprintf("assumed %s because %s", dec.Desc, why)
+	} else {
+		if dec = FindMemDecoder(format); dec == nil {
+			return nil, errors.New(fmt.Sprintf("unknown memory format \"%s\", use %s", format, MemFormatNames()))
+		}
+		why = fmt.Sprintf("read as %s", dec.Desc)
+	}
+	img, err := dec.Decode(buff, name)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Memory file, \"%s\" %s: %s", name, why, err.Error()))
+	}
+	return img, nil
+}
+
+/* Loads a memory file in the given format, or the detected format when format is empty or auto */
+func LoadMemFile(fp string, format string) (*MemImage, error) {
+	buff, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMem(buff, fp, format)
+}
+
+/* A memory file to load from -m, -ms, -mem or a config file */
+type MemFile struct {
+	File   string
+	Format string
+	Base   uint16
+}
+
+/* Parses file@base, the base is a number and defaults to 0 */
+func ParseMemFile(s string, format string) (MemFile, error) {
+	f := MemFile{File: s, Format: format}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		base, err := strconv.ParseUint(s[i+1:], 0, 16)
+		if err != nil || base >= 4096 {
+			return f, errors.New(fmt.Sprintf("bad load address in \"%s\", use file@base", s))
+		}
+		f.File = s[:i]
+		f.Base = uint16(base)
+	}
+	return f, nil
+}
+
+func (f MemFile) String() string {
+	if f.Base == 0 {
+		return f.File
+	}
+	return fmt.Sprintf("%s@%d", f.File, f.Base)
+}
+
+/* A flag that adds file@base arguments to a list of memory files */
+type memFlag struct {
+	Files  *[]MemFile
+	Format string
+}
+
+func (f memFlag) String() string {
+	if f.Files == nil {
+		return ""
+	}
+	names := make([]string, 0)
+	for _, v := range *f.Files {
+		if v.Format == f.Format {
+			names = append(names, v.String())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (f memFlag) Set(s string) error {
+	mf, err := ParseMemFile(s, f.Format)
+	if err != nil {
+		return err
+	}
+	*f.Files = append(*f.Files, mf)
+	return nil
+}
+
+/*
+ * Loads each file at its base address in order, so later files overwrite
+ * earlier ones where they overlap. Symbols from all of them and from any
+ * symbol files next to them are kept, as are the line maps next to them.
+ */
+func LoadMemFiles(m *mic1, files []MemFile) error {
+	syms := make([]Symbol, 0)
+	m.LineMap = nil
+	for _, v := range files {
+		img, err := LoadMemFile(v.File, v.Format)
+		if err != nil {
+			return err
+		}
+		img.Relocate(v.Base)
+		if err := m.LoadImage(img); err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", v.File, err.Error()))
+		}
+		syms = append(syms, img.Symbols...)
+		log.Printf("Loaded %d memory words in %d segments and %d symbols from %s", img.Len(), len(img.Segments), len(img.Symbols), v)
+		if fp := FindSymbolFile(v.File); fp != "" {
+			more, err := LoadSymbolFile(fp)
+			if err != nil {
+				return err
+			}
+			for i := range more {
+				more[i].Val += v.Base
+			}
+			syms = MergeSymbols(syms, more)
+			log.Printf("Loaded %d symbols from %s", len(more), fp)
+		}
+		if fp := FindLineMap(v.File); fp != "" {
+			if err := LoadLineMaps(m, []MemFile{{File: fp, Base: v.Base}}); err != nil {
+				return err
+			}
+		}
+	}
+	m.MemSymbols = syms
+	return nil
+}
+
+/*
+ * Clears memory and loads files as LoadMemFiles does, leaving memory, symbols
+ * and line maps as they were when any of them can't be loaded.
+ */
+func (m *mic1) ReplaceMem(files []MemFile) error {
+	loaded := new(mic1)
+	if err := LoadMemFiles(loaded, files); err != nil {
+		return err
+	}
+	m.Memory = loaded.Memory
+	m.MemSymbols = loaded.MemSymbols
+	m.LineMap = loaded.LineMap
+	m.Sources = nil
+	return nil
+}
+
+func sniffSRecord(buff []byte) string {
+	if l := firstLine(buff); len(l) >= 4 && l[0] == 'S' && l[1] >= '0' && l[1] <= '9' {
+		return "the first line starts with S" + string(l[1]) + " like an S-record"
+	}
+	return ""
+}
+
+var hexDumpLine = regexp.MustCompile(`^([0-9a-fA-F]+):((\s+[0-9a-fA-F]{1,4})+)\s*(\|.*)?$`)
+
+func sniffHexDump(buff []byte) string {
+	if hexDumpLine.MatchString(firstLine(buff)) {
+		return "the first line is a hex address, a colon and hex words"
+	}
+	return ""
+}
+
+func sniffBinaryStringMem(buff []byte) string {
+	if l := firstLine(buff); len(l) == 16 && isBinaryWord(l) {
+		return "the first line is 16 binary digits"
+	}
+	return ""
+}
+
+func DecodeBinaryMem(buff []byte, name string) (*MemImage, error) {
+	if len(buff)%2 != 0 {
+		return nil, errors.New(fmt.Sprintf("%d bytes is not a multiple of 2", len(buff)))
+	}
+	mem, err := ParseBinaryMem(buff, name)
+	if err != nil {
+		return nil, err
+	}
+	return &MemImage{Segments: []MemSegment{{0, mem}}, Symbols: make([]Symbol, 0)}, nil
+}
+
+func DecodeBinaryStringMem(buff []byte, name string) (*MemImage, error) {
+	mem, syms, err := ParseBinaryStringMem(bytes.NewReader(buff))
+	if err != nil {
+		return nil, err
+	}
+	return &MemImage{Segments: []MemSegment{{0, mem}}, Symbols: syms}, nil
+}
+
+/* Intel HEX with big-endian 16 bit words at byte addresses */
+func DecodeIntelHexMem(buff []byte, name string) (*MemImage, error) {
+	chunks, err := ParseIntelHex(buff)
+	if err != nil {
+		return nil, err
+	}
+	return chunkImage(chunks)
+}
+
+/* Motorola S-records with big-endian 16 bit words at byte addresses */
+func DecodeSRecordMem(buff []byte, name string) (*MemImage, error) {
+	chunks := make([]ByteChunk, 0)
+	lines, nums := textLines(buff)
+	for i, line := range lines {
+		if len(line) < 10 || line[0] != 'S' || len(line)%2 != 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: not an S-record", nums[i]))
+		}
+		rec, err := hexBytes(line[2:])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", nums[i], err.Error()))
+		}
+		if int(rec[0]) != len(rec)-1 {
+			return nil, errors.New(fmt.Sprintf("line %d: record length doesn't match its byte count", nums[i]))
+		}
+		var sum byte
+		for _, v := range rec {
+			sum += v
+		}
+		if sum != 0xFF {
+			return nil, errors.New(fmt.Sprintf("line %d: bad checksum", nums[i]))
+		}
+		alen := 0
+		switch line[1] {
+		case '1':
+			alen = 2
+		case '2':
+			alen = 3
+		case '3':
+			alen = 4
+		case '7', '8', '9':
+			return chunkImage(chunks)
+		case '0', '5', '6':
+			/* headers and record counts */
+			continue
+		default:
+			return nil, errors.New(fmt.Sprintf("line %d: unknown record type S%c", nums[i], line[1]))
+		}
+		if len(rec) < alen+2 {
+			return nil, errors.New(fmt.Sprintf("line %d: record too short for its address", nums[i]))
+		}
+		var addr uint32
+		for _, v := range rec[1 : 1+alen] {
+			addr = addr<<8 | uint32(v)
+		}
+		chunks = append(chunks, ByteChunk{addr, rec[1+alen : len(rec)-1], nums[i]})
+	}
+	return chunkImage(chunks)
+}
+
+/* Turns records of bytes into segments of words, joining records that follow on */
+func chunkImage(chunks []ByteChunk) (*MemImage, error) {
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Addr < chunks[j].Addr })
+	img := &MemImage{Segments: make([]MemSegment, 0), Symbols: make([]Symbol, 0)}
+	for i := 0; i < len(chunks); {
+		start := chunks[i]
+		data := append([]byte{}, start.Data...)
+		for i++; i < len(chunks) && chunks[i].Addr <= start.Addr+uint32(len(data)); i++ {
+			if chunks[i].Addr < start.Addr+uint32(len(data)) {
+				return nil, errors.New(fmt.Sprintf("line %d: overlaps the data at %#x", chunks[i].Line, chunks[i].Addr))
+			}
+			data = append(data, chunks[i].Data...)
+		}
+		if start.Addr%2 != 0 || len(data)%2 != 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: data at %#x isn't made of whole 16 bit words", start.Line, start.Addr))
+		}
+		if start.Addr/2+uint32(len(data)/2) > 4096 {
+			return nil, errors.New(fmt.Sprintf("line %d: data at %#x runs past the end of memory", start.Line, start.Addr))
+		}
+		words, _ := ParseBinaryMem(data, "")
+		img.Segments = append(img.Segments, MemSegment{uint16(start.Addr / 2), words})
+	}
+	return img, nil
+}
+
+/*
+ * Hex dumps with a hex word address, a colon and hex words on each line.
+ * Anything after a | is ignored, so dumps with an ASCII column work.
+ */
+func DecodeHexDumpMem(buff []byte, name string) (*MemImage, error) {
+	img := &MemImage{Segments: make([]MemSegment, 0), Symbols: make([]Symbol, 0)}
+	lines, nums := textLines(buff)
+	next := -1
+	for i, line := range lines {
+		f := hexDumpLine.FindStringSubmatch(line)
+		if f == nil {
+			return nil, errors.New(fmt.Sprintf("line %d: expected address: words", nums[i]))
+		}
+		addr, err := strconv.ParseUint(f[1], 16, 16)
+		if err != nil || addr >= 4096 {
+			return nil, errors.New(fmt.Sprintf("line %d: bad address \"%s\"", nums[i], f[1]))
+		}
+		words := make([]uint16, 0, 8)
+		for _, v := range strings.Fields(f[2]) {
+			w, _ := strconv.ParseUint(v, 16, 16)
+			words = append(words, uint16(w))
+		}
+		if int(addr)+len(words) > 4096 {
+			return nil, errors.New(fmt.Sprintf("line %d: runs past the end of memory", nums[i]))
+		}
+		if int(addr) == next {
+			s := &img.Segments[len(img.Segments)-1]
+			s.Words = append(s.Words, words...)
+		} else {
+			img.Segments = append(img.Segments, MemSegment{uint16(addr), words})
+		}
+		next = int(addr) + len(words)
+	}
+	return img, nil
+}
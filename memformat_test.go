@@ -0,0 +1,94 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeMem(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		data     string
+		segments []MemSegment
+		err      string
+	}{
+		{"binary string", "", "#n: 1\n0000000000000001\n1000000000000000\n", []MemSegment{{0, []uint16{1, 0x8000}}}, ""},
+		{"binary", "m", "\x00\x01\xff\x00", []MemSegment{{0, []uint16{1, 0xff00}}}, ""},
+		{"binary odd length", "m", "\x00\x01\xff", nil, "3 bytes is not a multiple of 2"},
+		{"intel hex", "", ":020000001234B8\n:00000001FF\n", []MemSegment{{0, []uint16{0x1234}}}, ""},
+		{"intel hex bad checksum", "", ":020000001234B9\n", nil, "line 1: bad checksum"},
+		{"intel hex past the end", "", ":02200000123498\n", nil, "line 1: data at 0x2000 runs past the end of memory"},
+		{"intel hex half word", "", ":0100010012EC\n", nil, "isn't made of whole 16 bit words"},
+		{"s-record", "", "S00700006D6963318E\nS10500001234B4\nS10500101234A4\nS9030000FC\n", []MemSegment{{0, []uint16{0x1234}}, {8, []uint16{0x1234}}}, ""},
+		{"s-record bad checksum", "", "S10500001234B5\n", nil, "line 1: bad checksum"},
+		{"s-record past the end", "", "S1052000123494\n", nil, "line 1: data at 0x2000 runs past the end of memory"},
+		{"s-record bad length", "srec", "S10600001234B4\n", nil, "line 1: record length doesn't match its byte count"},
+		{"hex dump", "", "000: 0001 0002 |..|\n002: 3\n010: ffff\n", []MemSegment{{0, []uint16{1, 2, 3}}, {0x10, []uint16{0xffff}}}, ""},
+		{"hex dump bad address", "", "1000: 0001\n", nil, "line 1: bad address \"1000\""},
+		{"hex dump past the end", "", "ffe: 1 2 3\n", nil, "line 1: runs past the end of memory"},
+		{"hex dump bad line", "dump", "000: 0001\nhello\n", nil, "line 2: expected address: words"},
+		{"unknown format", "", "hello there\n", nil, "is not in a known format"},
+	}
+	for _, tt := range tests {
+		img, err := DecodeMem([]byte(tt.data), "test", tt.format)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(img.Segments, tt.segments) {
+			t.Errorf("%s: got %v, want %v", tt.name, img.Segments, tt.segments)
+		}
+	}
+}
+
+/*
+ * Every format reads back what it writes, both by name and when detected.
+ * Binary formats fill the gaps between segments, so memory is compared.
+ */
+func TestMemRoundTrip(t *testing.T) {
+	img := &MemImage{Segments: []MemSegment{{0, []uint16{1, 0, 0xfffe}}, {100, []uint16{0x8000, 0x1234}}, {4094, []uint16{7, 8}}}}
+	base, words := img.flatten()
+	for _, dec := range MemDecoders {
+		var buff bytes.Buffer
+		if err := dec.Encode(&buff, img); err != nil {
+			t.Errorf("%s: %s", dec.Name, err)
+			continue
+		}
+		for _, format := range []string{dec.Name, "auto"} {
+			got, err := DecodeMem(buff.Bytes(), "test", format)
+			if err != nil {
+				t.Errorf("%s read as %s: %s", dec.Name, format, err)
+				continue
+			}
+			gotBase, gotWords := got.flatten()
+			if gotBase != base || !reflect.DeepEqual(gotWords, words) {
+				t.Errorf("%s read as %s: got %d words at %d, want %d at %d", dec.Name, format, len(gotWords), gotBase, len(words), base)
+			}
+		}
+	}
+}
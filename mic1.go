@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 )
@@ -31,14 +32,20 @@ const (
 	RUN
 )
 
+/* Default address of the memory mapped serial port */
+const SERIAL_BASE = 4092
+
 type mic1 struct {
 	Registers [16]uint16
 	Memory    [4096]uint16
 	MAR       uint16
 	MBR       uint16
-	ALU       *mic1Alu
+	ALU       mic1Alu
 	MPC       uint8
 	MCC       [256]*instruction
+	/* MCC decoded for the engine and set when it needs decoding again, see engine.go */
+	Ops      [256]microOp
+	opsStale int32
 
 	RD int8
 	WR int8
@@ -47,41 +54,132 @@ type mic1 struct {
 	MBRS uint16
 	/* MAR staging */
 	MARS uint16
-
-	State        int8
-	DesiredState int8
+	/* Addresses of the last completed read and write, 0xFFFF for none */
+	LastRead  uint16
+	LastWrite uint16
+	/* Cycles in which LastRead and LastWrite completed */
+	LastReadCycle  uint64
+	LastWriteCycle uint64
+
+	/* HALT or RUN, only accessed atomically, see Running and DesiredState */
+	state        int32
+	desiredState int32
 	Cycles       uint64
+	/* Why the last run or step halted early, nil if it didn't */
+	Fault error
+	/* Cycles per second of a run, 0 for as fast as possible, see SetClockRate */
+	clockRate int32
 
 	MemSymbols []Symbol
 
 	StateLock     *sync.Mutex
 	RegistersLock *sync.Mutex
 
-	/* Output state changes on this channel */
-	StateChanges chan int
+	/* Guards the run in progress, closing runDone when it stops, and the state change subscribers, see controller.go */
+	ctlLock sync.Mutex
+	runDone chan struct{}
+	subs    map[chan int]bool
 
 	/* Serial Output channel */
 	Output chan string
+	/* First of the serial port's receiver data, receiver status, transmitter data and transmitter status words */
+	SerialBase uint16
+	/* Serial IO is handled by a backend rather than the UI */
+	SerialExternal bool
 	/* Serial Input Channel */
 	Input chan string
+	/* Poll Input once per batch of cycles rather than every cycle */
+	BatchInput bool
 
 	/* RCRV and XMTR registers */
 	RCRV uint16
 	XMTR uint16
 
+	/* Address of the macro instruction being executed and the CALL sites of unfinished routines */
+	InstrPC   uint16
+	CallStack []uint16
+
 	/* Breakpoints for PC and MPC */
 	MPCBR []uint8
 	PCBR  []uint16
+	/* Memory addresses that halt the machine when written */
+	MemWatch []uint16
+
+	/* Treat the constant registers as read-only and optionally halt on a write */
+	ConstProtect bool
+	ConstHalt    bool
+	/* Writes attempted since the last reset and the last CONST_VIOLATIONS_KEPT of them */
+	ConstViolationCount uint64
+	ConstViolations     []ConstViolation
+
+	/* Microcode coverage, nil when not being recorded */
+	Coverage *Coverage
+	/* Per cycle profile, nil when not being recorded */
+	Profiler *Profiler
+	/* Log of macro instructions, nil when not being recorded */
+	Tracer *Tracer
+	/* Values written since the last step or run, nil when not being recorded */
+	Changes *Changes
+
+	/* Source lines of memory addresses and the source files read so far, see source.go */
+	LineMap map[uint16]SourceLoc
+	Sources map[string][]string
+
+	/* Copies of memory to diff against, see export.go */
+	Snapshots map[string]*MemImage
+}
+
+/* An attempted write to a constant register */
+type ConstViolation struct {
+	MPC   uint8
+	Cycle uint64
+	Reg   int8
+	Val   uint16
+}
+
+/* Constant register writes kept for reporting, older ones are only counted */
+const CONST_VIOLATIONS_KEPT = 16
+
+func (m *mic1) recordConstViolation(v ConstViolation) {
+	m.ConstViolationCount++
+	if len(m.ConstViolations) >= CONST_VIOLATIONS_KEPT {
+		copy(m.ConstViolations, m.ConstViolations[1:])
+		m.ConstViolations = m.ConstViolations[:len(m.ConstViolations)-1]
+	}
+	m.ConstViolations = append(m.ConstViolations, v)
+}
+
+/*
+ * Returns the constant register writes after the first seen ones that are
+ * still kept, and how many more were made that are no longer kept.
+ */
+func (m *mic1) ConstViolationsSince(seen uint64) ([]ConstViolation, uint64) {
+	if seen > m.ConstViolationCount {
+		/* the machine was reset */
+		seen = 0
+	}
+	n := m.ConstViolationCount - seen
+	kept := uint64(len(m.ConstViolations))
+	if n <= kept {
+		return m.ConstViolations[kept-n:], 0
+	}
+	return m.ConstViolations, n - kept
 }
 
 type Symbol struct {
 	Name string
 	Val  uint16
+	/* Only known from symbol files, see symfile.go */
+	Kind int
+	Size uint16
+	File string
+	Line int
 }
 
 func InitMic1() *mic1 {
-	m := &mic1{ALU: &mic1Alu{}, StateLock: &sync.Mutex{}, RegistersLock: &sync.Mutex{}, Cycles: 0, MemSymbols: make([]Symbol, 0)}
-	m.DesiredState = HALT
+	m := &mic1{StateLock: &sync.Mutex{}, RegistersLock: &sync.Mutex{}, Cycles: 0, MemSymbols: make([]Symbol, 0)}
+	m.setDesiredState(HALT)
+	m.MCChanged()
 	m.Registers[REG_PC] = 0
 	m.Registers[REG_SP] = 4091
 	m.Registers[REG_0] = 0
@@ -91,9 +189,9 @@ func InitMic1() *mic1 {
 	m.Registers[REG_SMASK] = 0x00FF
 
 	m.MARS = 0xFFFF
-
-	/* State change channel */
-	m.StateChanges = make(chan int)
+	m.LastRead = 0xFFFF
+	m.LastWrite = 0xFFFF
+	m.SerialBase = SERIAL_BASE
 
 	/* Setup the input and output channels */
 	m.Output = make(chan string, 100)
@@ -112,12 +210,11 @@ func (m *mic1) ZeroMC() {
 	for i := 0; i < len(m.MCC); i++ {
 		m.MCC[i] = nil
 	}
+	m.MCChanged()
 }
 
-func (m *mic1) Reset() {
-	m.DesiredState = HALT
-	m.RegistersLock.Lock()
-	defer m.RegistersLock.Unlock()
+/* Puts the registers back to their starting values, the machine must be locked */
+func (m *mic1) resetRegisters() {
 	m.Registers[REG_PC] = 0
 	m.Registers[REG_AC] = 0
 	m.Registers[REG_SP] = 4095
@@ -136,20 +233,85 @@ func (m *mic1) Reset() {
 	m.Registers[REG_F] = 0
 
 	m.MARS = 0xFFFF
+	m.LastRead = 0xFFFF
+	m.LastWrite = 0xFFFF
 	m.MBR = 0
 	m.MPC = 0
 	m.Cycles = 0
+	m.Fault = nil
+	m.ConstViolationCount = 0
+	m.ConstViolations = nil
+	m.InstrPC = 0
+	m.CallStack = nil
 }
 
 func (m *mic1) AddMPCBR(br uint8) {
 	m.MPCBR = append(m.MPCBR, br)
 }
 
+/* Adds a breakpoint that halts before the macro instruction at br is fetched */
+func (m *mic1) AddPCBR(br uint16) {
+	if !m.IsPCBR(br) {
+		m.PCBR = append(m.PCBR, br)
+	}
+}
+
+func (m *mic1) RemovePCBR(br uint16) {
+	for i, v := range m.PCBR {
+		if v == br {
+			m.PCBR = append(m.PCBR[:i], m.PCBR[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *mic1) AddWatch(addr uint16) {
+	if !m.IsWatched(addr) {
+		m.MemWatch = append(m.MemWatch, addr)
+	}
+}
+
+func (m *mic1) RemoveWatch(addr uint16) {
+	for i, v := range m.MemWatch {
+		if v == addr {
+			m.MemWatch = append(m.MemWatch[:i], m.MemWatch[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *mic1) IsWatched(addr uint16) bool {
+	for _, v := range m.MemWatch {
+		if v == addr {
+			return true
+		}
+	}
+	return false
+}
+
+/* Returns the address of the most recent completed read or write */
+func (m *mic1) LastAccess() (uint16, bool) {
+	if m.LastWrite != 0xFFFF && (m.LastRead == 0xFFFF || m.LastWriteCycle >= m.LastReadCycle) {
+		return m.LastWrite, true
+	}
+	return m.LastRead, m.LastRead != 0xFFFF
+}
+
+func (m *mic1) IsPCBR(pc uint16) bool {
+	for _, v := range m.PCBR {
+		if v == pc {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *mic1) LoadMC(mc []uint32) {
 	for i, v := range mc {
 		ins := Unpack(v)
 		m.MCC[i] = &ins
 	}
+	m.MCChanged()
 }
 
 func (m *mic1) LoadMem(mem []uint16) {
@@ -158,98 +320,132 @@ func (m *mic1) LoadMem(mem []uint16) {
 	}
 }
 
-func (m *mic1) Run() {
-	if m.DesiredState == RUN {
-		m.State = RUN
-		m.StateChanges <- RUN
-	}
-	for {
-		// check if we should run
-		if m.DesiredState == RUN {
-			m.Step()
-		} else {
-			m.State = HALT
-			m.StateChanges <- HALT
-			break
-		}
+/* Loads memory starting at base, returning an error if it doesn't fit */
+func (m *mic1) LoadMemAt(mem []uint16, base uint16) error {
+	if int(base)+len(mem) > len(m.Memory) {
+		return errors.New(fmt.Sprintf("%d words at %d run past the end of memory", len(mem), base))
 	}
+	copy(m.Memory[base:], mem)
+	return nil
 }
 
-/* Executes one microcode cycle */
-func (m *mic1) Step() {
-	m.RegistersLock.Lock()
-	defer m.RegistersLock.Unlock()
-	ins := m.MCC[m.MPC]
-	if ins == nil {
-		emsg := fmt.Sprintf("Error: undefined microcode instruction at address: %d\n", m.MPC)
-		panic(emsg)
+/*
+ * Executes one microcode cycle from the decoded table, the machine must be
+ * locked. Reaching an empty control store slot sets Fault and halts instead.
+ */
+func (m *mic1) cycle() {
+	ins := &m.Ops[m.MPC]
+	if !ins.Valid {
+		m.Fault = errors.New(fmt.Sprintf("undefined microcode instruction at address: %d", m.MPC))
+		m.setDesiredState(HALT)
+		return
+	}
+	if m.Profiler != nil {
+		m.Profiler.Sample(m)
+	}
+	if m.Tracer != nil && m.MPC == 0 {
+		m.Tracer.Record(m)
 	}
 	// Set ALU's B input
 	m.ALU.B = m.Registers[ins.B]
 	// Set ALU's A input
-	if ins.AMUX == 1 {
+	if ins.A == MBR_BUS {
 		m.ALU.A = m.MBR
 	} else {
 		m.ALU.A = m.Registers[ins.A]
 	}
 	// Set ALU function
-	m.ALU.F = ins.ALU
+	m.ALU.F = int8(ins.ALU)
 	// Set ALU shifter
-	m.ALU.S = ins.SH
+	m.ALU.S = int8(ins.SH)
 
 	/* Sub step 3 */
-	if ins.MAR == 1 {
+	if ins.MAR {
+		if m.Changes != nil {
+			m.Changes.reg(CHANGE_MAR, m.MAR)
+		}
 		m.MAR = m.Registers[ins.B]
 	}
 
 	m.ALU.Calc()
 	/* Sub step 4 */
-	if ins.MBR == 1 {
+	if ins.MBR {
+		if m.Changes != nil {
+			m.Changes.reg(CHANGE_MBR, m.MBR)
+		}
 		m.MBR = m.ALU.R
 	}
-	if ins.ENC == 1 {
-		m.Registers[ins.C] = m.ALU.R
+	if ins.ENC {
+		if m.ConstProtect && IsConstReg(int8(ins.C)) {
+			m.recordConstViolation(ConstViolation{MPC: m.MPC, Cycle: m.Cycles, Reg: int8(ins.C), Val: m.ALU.R})
+			if m.ConstHalt {
+				m.setDesiredState(HALT)
+			}
+		} else {
+			if m.Changes != nil {
+				m.Changes.reg(int(ins.C), m.Registers[ins.C])
+			}
+			m.Registers[ins.C] = m.ALU.R
+		}
 	}
 
-	m.RD = ins.RD
-	m.WR = ins.WR
+	m.RD = 0
+	if ins.RD {
+		m.RD = 1
+	}
+	m.WR = 0
+	if ins.WR {
+		m.WR = 1
+	}
 
+	addr := m.MPC
+	taken := false
 	m.MPC++
 	switch ins.COND {
 	case 1:
 		if m.ALU.N == 1 {
 			m.MPC = ins.ADDR
+			taken = true
 		}
 	case 2:
 		if m.ALU.Z == 1 {
 			m.MPC = ins.ADDR
+			taken = true
 		}
 	case 3:
 		m.MPC = ins.ADDR
 	}
+	if m.Coverage != nil {
+		m.Coverage.Record(addr, m.MCC[addr], taken)
+	}
 
 	if m.RD == 1 && m.WR == 1 {
-		m.DesiredState = HALT
+		m.setDesiredState(HALT)
 	} else if m.RD == 1 {
 		// check if READ is set
 		if m.MARS != 0xFFFF {
 			// Cycle 2
 			// check if there is an address in the MAR staging
+			if m.Changes != nil {
+				m.Changes.reg(CHANGE_MBR, m.MBR)
+			}
 			switch m.MARS {
-			case 4092:
+			case m.SerialBase:
 				if m.RCRV&10 == 10 {
 					m.RCRV = 9
 				}
-				m.MBR = m.Memory[4092]
-			case 4093:
+				m.MBR = m.Memory[m.SerialBase]
+			case m.SerialBase + 1:
 				m.MBR = m.RCRV
-			case 4094:
-				m.MBR = m.Memory[4094]
-			case 4095:
+			case m.SerialBase + 2:
+				m.MBR = m.Memory[m.SerialBase+2]
+			case m.SerialBase + 3:
 				m.MBR = m.XMTR
 			default:
 				m.MBR = m.Memory[m.MARS]
 			}
+			m.LastRead = m.MARS
+			m.LastReadCycle = m.Cycles
 			m.MARS = 0xFFFF
 		} else {
 			// Cycle 1
@@ -262,19 +458,22 @@ func (m *mic1) Step() {
 		if m.MARS != 0xFFFF {
 			// Cycle 2
 			// write the value in MBR staging to memory
+			if m.Changes != nil {
+				m.Changes.mem(m.MARS, m.Memory[m.MARS])
+			}
 
 			// check for memory mapped IO
 			switch m.MARS {
-			case 4092:
+			case m.SerialBase:
 				// writing the RCRV location in memory
 				m.Memory[m.MARS] = m.MBRS
-			case 4093:
+			case m.SerialBase + 1:
 				// writing to the RCRV status register
 				if m.MBRS == 8 {
 					// Enable the receiver
 					m.RCRV = 9
 				}
-			case 4094:
+			case m.SerialBase + 2:
 				// writing to the XMTR location in memory
 				m.Memory[m.MARS] = m.MBRS
 				if m.XMTR&8 != 0 {
@@ -282,7 +481,7 @@ func (m *mic1) Step() {
 					m.Output <- string(rune(m.MBRS & 0xFF))
 					m.XMTR = 10
 				}
-			case 4095:
+			case m.SerialBase + 3:
 				// writing to the XMTR status register
 				if m.MBRS == 8 {
 					// Enable the transmitter
@@ -292,6 +491,11 @@ func (m *mic1) Step() {
 			default:
 				m.Memory[m.MARS] = m.MBRS
 			}
+			m.LastWrite = m.MARS
+			m.LastWriteCycle = m.Cycles
+			if len(m.MemWatch) > 0 && m.IsWatched(m.MARS) {
+				m.setDesiredState(HALT)
+			}
 			m.MARS = 0xFFFF
 		} else {
 			// Cycle 1
@@ -302,15 +506,17 @@ func (m *mic1) Step() {
 		}
 	}
 	m.Cycles++
-	if m.MCC[m.MPC] != nil && m.MCC[m.MPC].BR {
-		m.DesiredState = HALT
+	if m.Ops[m.MPC].BR {
+		m.setDesiredState(HALT)
 	}
-	if m.RCRV&9 == 9 {
-		select {
-		case in := <-m.Input:
-			m.Memory[4092] = uint16(in[0])
-			m.RCRV = 10
-		default:
+	/* Macro instructions are fetched starting at MPC 0 */
+	if m.MPC == 0 {
+		m.EndInstruction()
+		if len(m.PCBR) > 0 && m.IsPCBR(m.Registers[REG_PC]) {
+			m.setDesiredState(HALT)
 		}
 	}
+	if m.RCRV&9 == 9 && !m.BatchInput {
+		m.pollInput()
+	}
 }
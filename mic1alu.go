@@ -33,22 +33,17 @@ func (m *mic1Alu) Calc() {
 	case 2:
 		m.R = m.A
 	case 3:
-		m.R = m.A ^ 0xFFFF
+		m.R = ^m.A
 	}
 
 	// set zero flag
+	m.Z = 0
 	if m.R == 0 {
 		m.Z = 1
-	} else {
-		m.Z = 0
 	}
 
 	// set negative flag
-	if m.R&0x8000 != 0 {
-		m.N = 1
-	} else {
-		m.N = 0
-	}
+	m.N = int8(m.R >> 15)
 	switch m.S {
 	case 1:
 		m.R = m.R >> 1
@@ -0,0 +1,252 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* Location and function ids for macro instructions start after the 256 microcode slots */
+const (
+	PROF_MACRO_BASE = 257
+	PROF_FUNC_BASE  = 257
+)
+
+/*
+ * Samples the machine every microcycle. Each sample's stack is the microcode
+ * slot, the macro instruction being executed and the CALL sites of every
+ * routine that has not returned yet.
+ */
+type Profiler struct {
+	/* Files the microcode and memory were loaded from */
+	MCFile  string
+	MemFile string
+
+	Start  time.Time
+	Counts map[string]int64
+	key    []byte
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{Start: time.Now(), Counts: make(map[string]int64)}
+}
+
+/* Records one microcycle, call before the instruction at MPC is executed */
+func (p *Profiler) Sample(m *mic1) {
+	p.key = append(p.key[:0], m.MPC, byte(m.InstrPC>>8), byte(m.InstrPC))
+	for i := len(m.CallStack) - 1; i >= 0; i-- {
+		p.key = append(p.key, byte(m.CallStack[i]>>8), byte(m.CallStack[i]))
+	}
+	p.Counts[string(p.key)]++
+}
+
+/* Writes the samples as a gzipped pprof protobuf */
+func (p *Profiler) Write(w io.Writer, m *mic1) error {
+	strs := []string{""}
+	stri := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		if i, ok := stri[s]; ok {
+			return i
+		}
+		stri[s] = int64(len(strs))
+		strs = append(strs, s)
+		return stri[s]
+	}
+
+	/* Symbols sorted by address so a PC can be mapped to the routine it is in */
+	syms := m.SortedSymbols()
+	symFor := func(pc uint16) int {
+		i := sort.Search(len(syms), func(i int) bool {
+			return syms[i].Val > pc
+		})
+		return i - 1
+	}
+
+	var out protoBuf
+	var msg protoBuf
+	valueType := func(tag int, typ string, unit string) {
+		msg.Reset()
+		msg.int64Field(1, str(typ))
+		msg.int64Field(2, str(unit))
+		out.bytesField(tag, msg.Bytes())
+	}
+	valueType(1, "cycles", "count")
+
+	/* Samples */
+	keys := make([]string, 0, len(p.Counts))
+	for k := range p.Counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	usedMC := make(map[uint8]bool)
+	usedPC := make(map[uint16]bool)
+	for _, k := range keys {
+		locs := []uint64{uint64(k[0]) + 1}
+		usedMC[k[0]] = true
+		for i := 1; i+1 < len(k); i += 2 {
+			pc := uint16(k[i])<<8 | uint16(k[i+1])
+			locs = append(locs, PROF_MACRO_BASE+uint64(pc))
+			usedPC[pc] = true
+		}
+		msg.Reset()
+		msg.packedField(1, locs)
+		msg.packedField(2, []uint64{uint64(p.Counts[k])})
+		out.bytesField(2, msg.Bytes())
+	}
+
+	/* Locations, one per microcode slot and one per macro instruction address */
+	var line protoBuf
+	location := func(id uint64, addr uint64, fn uint64, ln int64) {
+		line.Reset()
+		line.uint64Field(1, fn)
+		line.int64Field(2, ln)
+		msg.Reset()
+		msg.uint64Field(1, id)
+		msg.uint64Field(3, addr)
+		msg.bytesField(4, line.Bytes())
+		out.bytesField(4, msg.Bytes())
+	}
+	mcs := make([]int, 0, len(usedMC))
+	for mpc := range usedMC {
+		mcs = append(mcs, int(mpc))
+	}
+	sort.Ints(mcs)
+	for _, mpc := range mcs {
+		location(uint64(mpc)+1, uint64(mpc), uint64(mpc)+1, int64(mpc))
+	}
+	pcs := make([]int, 0, len(usedPC))
+	for pc := range usedPC {
+		pcs = append(pcs, int(pc))
+	}
+	sort.Ints(pcs)
+	usedSym := make(map[int]bool)
+	for _, pc := range pcs {
+		si := symFor(uint16(pc))
+		usedSym[si] = true
+		location(PROF_MACRO_BASE+uint64(pc), uint64(pc), uint64(PROF_FUNC_BASE+si+1), int64(pc))
+	}
+
+	/* Functions */
+	function := func(id uint64, name string, file string, start int64) {
+		msg.Reset()
+		msg.uint64Field(1, id)
+		msg.int64Field(2, str(name))
+		msg.int64Field(3, str(name))
+		msg.int64Field(4, str(file))
+		msg.int64Field(5, start)
+		out.bytesField(5, msg.Bytes())
+	}
+	for _, mpc := range mcs {
+		name := fmt.Sprintf("mc %d", mpc)
+		if m.MCC[mpc] != nil {
+			name = fmt.Sprintf("mc %d: %s", mpc, strings.TrimSpace(m.MCC[mpc].ToString()))
+		}
+		function(uint64(mpc)+1, name, p.MCFile, int64(mpc))
+	}
+	sis := make([]int, 0, len(usedSym))
+	for si := range usedSym {
+		sis = append(sis, si)
+	}
+	sort.Ints(sis)
+	for _, si := range sis {
+		if si < 0 {
+			function(PROF_FUNC_BASE, "(no symbol)", p.MemFile, 0)
+		} else {
+			function(uint64(PROF_FUNC_BASE+si+1), syms[si].Name, p.MemFile, int64(syms[si].Val))
+		}
+	}
+
+	/* Everything referring to the string table has been written */
+	for _, s := range strs {
+		out.stringField(6, s)
+	}
+	out.int64Field(9, p.Start.UnixNano())
+	out.int64Field(10, int64(time.Since(p.Start)))
+	valueType(11, "cycles", "count")
+	out.int64Field(12, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+/* Writes the profile to the given file */
+func (p *Profiler) Save(fp string, m *mic1) error {
+	file, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	err = p.Write(file, m)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/* Just enough of the protobuf wire format to write a pprof profile */
+type protoBuf struct {
+	bytes.Buffer
+}
+
+func (b *protoBuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuf) uint64Field(tag int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(tag) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuf) int64Field(tag int, x int64) {
+	b.uint64Field(tag, uint64(x))
+}
+
+func (b *protoBuf) bytesField(tag int, data []byte) {
+	b.varint(uint64(tag)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuf) stringField(tag int, s string) {
+	b.varint(uint64(tag)<<3 | 2)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+func (b *protoBuf) packedField(tag int, xs []uint64) {
+	var tmp protoBuf
+	for _, x := range xs {
+		tmp.varint(x)
+	}
+	b.bytesField(tag, tmp.Bytes())
+}
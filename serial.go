@@ -0,0 +1,115 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+/*
+ * Serial backends connect the memory mapped serial port to something other
+ * than the UI:
+ *   stdio       the CLI reads and writes the terminal (the default), the
+ *               TUI discards output
+ *   null        output is discarded and there is no input
+ *   tcp:addr    a TCP client sends input and receives output, output is
+ *               discarded while nobody is connected
+ */
+func StartSerial(m *mic1, spec string) error {
+	switch {
+	case spec == "" || spec == "stdio":
+		return nil
+	case spec == "null":
+		m.SerialExternal = true
+		go func() {
+			for range m.Output {
+			}
+		}()
+		return nil
+	case strings.HasPrefix(spec, "tcp:"):
+		addr := spec[4:]
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		log.Println("Serial port listening on", l.Addr().String())
+		m.SerialExternal = true
+		s := &tcpSerial{Mic: m}
+		go s.pumpOutput()
+		go s.accept(l)
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown serial backend \"%s\", use stdio, null or tcp:address", spec))
+}
+
+type tcpSerial struct {
+	Mic  *mic1
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (s *tcpSerial) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		s.lock.Lock()
+		if s.conn != nil {
+			/* one client at a time, the newest wins */
+			s.conn.Close()
+		}
+		s.conn = conn
+		s.lock.Unlock()
+		go s.pumpInput(conn)
+	}
+}
+
+func (s *tcpSerial) pumpInput(conn net.Conn) {
+	buff := make([]byte, 256)
+	for {
+		n, err := conn.Read(buff)
+		for _, b := range buff[:n] {
+			s.Mic.Input <- string(rune(b))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *tcpSerial) pumpOutput() {
+	for out := range s.Mic.Output {
+		s.lock.Lock()
+		if s.conn != nil {
+			if _, err := s.conn.Write([]byte(out)); err != nil {
+				s.conn.Close()
+				s.conn = nil
+			}
+		}
+		s.lock.Unlock()
+	}
+}
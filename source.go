@@ -0,0 +1,272 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Line maps tie memory addresses to the assembly source they came from. Each
+ * line is
+ *   address file:line
+ * and # starts a comment. Relative source files are found from the line map's
+ * directory. A line map next to a memory image with the same name and a
+ * .lines extension is loaded with it.
+ */
+
+const LINE_MAP_EXT = ".lines"
+
+type SourceLoc struct {
+	File string
+	Line int
+}
+
+func (l SourceLoc) String() string {
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+/* Parses a line map, name is only used in errors and dir is where relative source files are */
+func ParseLineMap(r io.Reader, name string, dir string) (map[uint16]SourceLoc, error) {
+	ret := make(map[uint16]SourceLoc)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, errors.New(fmt.Sprintf("Line map, \"%s\": line %d: expected an address and file:line", name, n))
+		}
+		addr, err := strconv.ParseUint(f[0], 0, 16)
+		if err != nil || addr >= 4096 {
+			return nil, errors.New(fmt.Sprintf("Line map, \"%s\": line %d: bad address \"%s\"", name, n, f[0]))
+		}
+		i := strings.LastIndex(f[1], ":")
+		l, err := strconv.Atoi(f[1][i+1:])
+		if i <= 0 || err != nil || l < 1 {
+			return nil, errors.New(fmt.Sprintf("Line map, \"%s\": line %d: bad source location \"%s\", use file:line", name, n, f[1]))
+		}
+		file := f[1][:i]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		ret[uint16(addr)] = SourceLoc{file, l}
+	}
+	return ret, s.Err()
+}
+
+func LoadLineMap(fp string) (map[uint16]SourceLoc, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseLineMap(file, fp, filepath.Dir(fp))
+}
+
+/* Returns the line map next to a memory image, or "" when there isn't one */
+func FindLineMap(image string) string {
+	stem := strings.TrimSuffix(image, filepath.Ext(image))
+	for _, fp := range []string{stem + LINE_MAP_EXT, image + LINE_MAP_EXT} {
+		if fp == image {
+			continue
+		}
+		if _, err := os.Stat(fp); err == nil {
+			return fp
+		}
+	}
+	return ""
+}
+
+/* Adds a line map to the machine's, moving it up by base */
+func (m *mic1) AddLineMap(lines map[uint16]SourceLoc, base uint16) {
+	if m.LineMap == nil {
+		m.LineMap = make(map[uint16]SourceLoc)
+	}
+	for a, v := range lines {
+		m.LineMap[(a+base)&0x0FFF] = v
+	}
+	/* the sources are read again in case they changed */
+	m.Sources = nil
+}
+
+/* Loads line map files, moving each up by its base */
+func LoadLineMaps(m *mic1, files []MemFile) error {
+	for _, v := range files {
+		lines, err := LoadLineMap(v.File)
+		if err != nil {
+			return err
+		}
+		m.AddLineMap(lines, v.Base)
+		log.Printf("Loaded %d source lines from %s", len(lines), v)
+	}
+	return nil
+}
+
+func (m *mic1) HasSource() bool {
+	return len(m.LineMap) > 0
+}
+
+/* Returns the source line an address came from */
+func (m *mic1) SourceFor(addr uint16) (SourceLoc, bool) {
+	loc, ok := m.LineMap[addr&0x0FFF]
+	return loc, ok
+}
+
+func sameSource(a string, b string) bool {
+	if a == b || filepath.Base(a) == b || filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	/* a debugger client gives absolute paths */
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+/*
+ * Returns the first address of file:line, or of the next line after it with
+ * code, the file can be given without its directory. Symbol file locations
+ * are used when there is no line map for the file.
+ */
+func (m *mic1) AddrForSource(file string, line int) (uint16, bool) {
+	best := -1
+	bestLine := 0
+	for a, v := range m.LineMap {
+		if v.Line < line || !sameSource(v.File, file) {
+			continue
+		}
+		if best < 0 || v.Line < bestLine || (v.Line == bestLine && int(a) < best) {
+			best = int(a)
+			bestLine = v.Line
+		}
+	}
+	if best >= 0 {
+		return uint16(best), true
+	}
+	if sym, ok := m.SymbolAtSource(file, line); ok {
+		return sym.Val, true
+	}
+	return 0, false
+}
+
+/* Returns the lines of a source file, files are only read once until the line map changes */
+func (m *mic1) SourceLines(file string) []string {
+	if m.Sources == nil {
+		m.Sources = make(map[string][]string)
+	}
+	if lines, ok := m.Sources[file]; ok {
+		return lines
+	}
+	lines := make([]string, 0)
+	if f, err := os.Open(file); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			lines = append(lines, strings.Replace(s.Text(), "\t", "    ", -1))
+		}
+		f.Close()
+	}
+	m.Sources[file] = lines
+	return lines
+}
+
+/* Returns the text of a source line, or "" when the file can't be read */
+func (m *mic1) SourceLine(loc SourceLoc) string {
+	lines := m.SourceLines(loc.File)
+	if loc.Line < 1 || loc.Line > len(lines) {
+		return ""
+	}
+	return strings.TrimSpace(lines[loc.Line-1])
+}
+
+/* Describes where an address came from as file:line: text */
+func (m *mic1) SourceString(addr uint16) string {
+	loc, ok := m.SourceFor(addr)
+	if !ok {
+		return ""
+	}
+	if t := m.SourceLine(loc); t != "" {
+		return fmt.Sprintf("%s: %s", loc, t)
+	}
+	return loc.String()
+}
+
+/* Returns the lines of a source file that have a PC breakpoint */
+func (m *mic1) SourceBreaks(file string) map[int]bool {
+	ret := make(map[int]bool)
+	for _, a := range m.PCBR {
+		if loc, ok := m.SourceFor(a); ok && loc.File == file {
+			ret[loc.Line] = true
+		}
+	}
+	return ret
+}
+
+/* Stop condition for running until the PC reaches a different source line */
+func (m *mic1) StepLineCond() func(m *mic1) bool {
+	start, ok := m.SourceFor(m.CurrentPC())
+	return func(m *mic1) bool {
+		loc, at := m.SourceFor(m.CurrentPC())
+		return at && (!ok || loc != start)
+	}
+}
+
+/* Writes a line for every macro instruction fetched */
+type Tracer struct {
+	File *os.File
+	W    *bufio.Writer
+}
+
+func NewTracer(fp string) (*Tracer, error) {
+	f, err := os.Create(fp)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{File: f, W: bufio.NewWriter(f)}
+	fmt.Fprintf(t.W, "# cycle address <symbol> instruction [file:line]\n")
+	return t, nil
+}
+
+/* Records the macro instruction about to be fetched, the machine must be locked */
+func (t *Tracer) Record(m *mic1) {
+	pc := m.Registers[REG_PC] & 0x0FFF
+	fmt.Fprintf(t.W, "%-10d 0x%03x <%s> %s", m.Cycles, pc, m.AddrName(pc), m.DisassembleAt(pc))
+	if loc, ok := m.SourceFor(pc); ok {
+		fmt.Fprintf(t.W, "  %s", loc)
+	}
+	fmt.Fprint(t.W, "\n")
+}
+
+func (t *Tracer) Close() error {
+	if err := t.W.Flush(); err != nil {
+		t.File.Close()
+		return err
+	}
+	return t.File.Close()
+}
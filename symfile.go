@@ -0,0 +1,190 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Symbol files give names to the addresses of any memory image. Each line is
+ *   name address [code|data] [size] [file:line]
+ * where the fields after the address are optional and can come in any order,
+ * and # starts a comment. A symbol file next to a memory image with the same
+ * name and a .sym or .map extension is loaded with it.
+ */
+
+const (
+	SYM_UNKNOWN = iota
+	SYM_CODE
+	SYM_DATA
+)
+
+var SymKindNames = []string{"", "code", "data"}
+
+var SymFileExts = []string{".sym", ".map"}
+
+/* Parses a symbol file, name is only used in errors */
+func ParseSymbolFile(r io.Reader, name string) ([]Symbol, error) {
+	ret := make([]Symbol, 0)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, errors.New(fmt.Sprintf("Symbol file, \"%s\": line %d: expected a name and an address", name, n))
+		}
+		addr, err := strconv.ParseUint(f[1], 0, 16)
+		if err != nil || addr >= 4096 {
+			return nil, errors.New(fmt.Sprintf("Symbol file, \"%s\": line %d: bad address \"%s\"", name, n, f[1]))
+		}
+		sym := Symbol{Name: f[0], Val: uint16(addr)}
+		for _, v := range f[2:] {
+			switch {
+			case v == "code":
+				sym.Kind = SYM_CODE
+			case v == "data":
+				sym.Kind = SYM_DATA
+			case strings.Contains(v, ":"):
+				i := strings.LastIndex(v, ":")
+				l, err := strconv.Atoi(v[i+1:])
+				if err != nil || i == 0 || l < 1 {
+					return nil, errors.New(fmt.Sprintf("Symbol file, \"%s\": line %d: bad source location \"%s\", use file:line", name, n, v))
+				}
+				sym.File = v[:i]
+				sym.Line = l
+			default:
+				size, err := strconv.ParseUint(v, 0, 16)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("Symbol file, \"%s\": line %d: \"%s\" is not code, data, a size or file:line", name, n, v))
+				}
+				sym.Size = uint16(size)
+			}
+		}
+		ret = append(ret, sym)
+	}
+	return ret, s.Err()
+}
+
+func LoadSymbolFile(fp string) ([]Symbol, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseSymbolFile(file, fp)
+}
+
+/* Returns the symbol file next to a memory image, or "" when there isn't one */
+func FindSymbolFile(image string) string {
+	stem := strings.TrimSuffix(image, filepath.Ext(image))
+	for _, ext := range SymFileExts {
+		for _, fp := range []string{stem + ext, image + ext} {
+			if fp == image {
+				continue
+			}
+			if _, err := os.Stat(fp); err == nil {
+				return fp
+			}
+		}
+	}
+	return ""
+}
+
+/* Adds more to syms, replacing symbols with the same name */
+func MergeSymbols(syms []Symbol, more []Symbol) []Symbol {
+	for _, v := range more {
+		found := false
+		for i := range syms {
+			if syms[i].Name == v.Name {
+				syms[i] = v
+				found = true
+				break
+			}
+		}
+		if !found {
+			syms = append(syms, v)
+		}
+	}
+	return syms
+}
+
+/* Loads symbol files, moving each up by its base, and adds them to the machine's symbols */
+func LoadSymbolFiles(m *mic1, files []MemFile) error {
+	for _, v := range files {
+		syms, err := LoadSymbolFile(v.File)
+		if err != nil {
+			return err
+		}
+		for i := range syms {
+			syms[i].Val += v.Base
+		}
+		m.MemSymbols = MergeSymbols(m.MemSymbols, syms)
+		log.Printf("Loaded %d symbols from %s", len(syms), v)
+	}
+	return nil
+}
+
+/* Describes a symbol's kind, size and source location */
+func (s Symbol) Info() string {
+	ret := make([]string, 0, 3)
+	if s.Kind != SYM_UNKNOWN {
+		ret = append(ret, SymKindNames[s.Kind])
+	}
+	if s.Size == 1 {
+		ret = append(ret, "1 word")
+	} else if s.Size != 0 {
+		ret = append(ret, fmt.Sprintf("%d words", s.Size))
+	}
+	if s.File != "" {
+		ret = append(ret, fmt.Sprintf("%s:%d", s.File, s.Line))
+	}
+	return strings.Join(ret, ", ")
+}
+
+/* Returns the symbol at file:line, the file can be given without its directory */
+func (m *mic1) SymbolAtSource(file string, line int) (Symbol, bool) {
+	for _, v := range m.MemSymbols {
+		if v.Line == line && v.File != "" && (v.File == file || filepath.Base(v.File) == file) {
+			return v, true
+		}
+	}
+	return Symbol{}, false
+}
+
+/* Disassembles the word at addr, words inside data symbols are shown as data */
+func (m *mic1) DisassembleAt(addr uint16) string {
+	w := m.Memory[addr&0x0FFF]
+	if sym, ok := m.SymbolFor(addr); ok && sym.Kind == SYM_DATA {
+		return fmt.Sprintf(".word %d", w)
+	}
+	return m.Disassemble(w)
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/jroimartin/gocui"
@@ -35,18 +36,52 @@ type TUI struct {
 	MemAddr int
 	MemMin  int
 	MemHex  bool
-	SymPos  int
-	SymMin  int
-	SymHex  bool
-	MCPos   int
-	MCMin   int
-	VCycle  []*gocui.View
-	CView   int
+	/* Selected word within the memory row */
+	MemCol int
+	RegPos int
+	SymPos int
+	SymMin int
+	SymHex bool
+	MCPos  int
+	MCMin  int
+	VCycle []*gocui.View
+	CView  int
 	/* human readable microcode */
 	MC []string
 	/* Microcode and memory reload functions */
 	MR  func(m *mic1) error
 	MCR func(m *mic1) error
+	/* Why the last reload failed, shown in the status until the next one */
+	ReloadErr error
+	/* Open prompt's title and the function handling its text */
+	PromptTitle string
+	PromptDone  func(string) error
+	/* Last memory search */
+	Search       []SearchWord
+	SearchText   string
+	SearchStatus string
+	/* Follow modes and the address last followed */
+	MemFollow   int
+	MemFollowed int
+	MCFollow    bool
+	MCFollowed  int
+	/* Source frame's file, cursor and first line shown and the PC line last followed */
+	SrcFile     string
+	SrcPos      int
+	SrcMin      int
+	SrcFollow   bool
+	SrcFollowed SourceLoc
+	/* The changes frame is shown over the symbols frame */
+	ShowChanges bool
+	/* Watched expressions, the selected one and the first shown */
+	Watches  []*Watch
+	WatchPos int
+	WatchMin int
+	/* Cycles per second of animate mode, see tuianimate.go */
+	ClockRate int
+	/* Key mappings and the keys typed so far of a chord */
+	Keys  []KeyMapping
+	Chord []KeyPress
 }
 
 func (u *TUI) Run() error {
@@ -57,7 +92,7 @@ func (u *TUI) Run() error {
 	return nil
 }
 
-func initGui(m *mic1) (*TUI, error) {
+func initGui(m *mic1, keys []KeyMapping) (*TUI, error) {
 	var err error
 	u := &TUI{Mic: m}
 	u.MemAddr = 0x0000
@@ -68,8 +103,24 @@ func initGui(m *mic1) (*TUI, error) {
 	u.SymHex = false
 	u.MCPos = 0
 	u.MCMin = 0
-	u.VCycle = make([]*gocui.View, 0, 4)
-	u.CView = 1
+	u.MCFollow = true
+	u.MCFollowed = -1
+	u.MemFollowed = -1
+	u.SrcFollow = true
+	u.Mic.Changes = NewChanges()
+	states, _ := u.Mic.Subscribe()
+	go u.MicWatcher(states)
+	u.ClockRate = CLOCK_DEFAULT
+	go u.AnimateFrames()
+	/* the TUI has no serial console, so output is discarded unless a serial backend owns the port */
+	if !u.Mic.SerialExternal {
+		go func() {
+			for range u.Mic.Output {
+			}
+		}()
+	}
+	u.VCycle = make([]*gocui.View, 0, 5)
+	u.CView = 2
 	u.MC = make([]string, 256, 256)
 	u.Gui, err = gocui.NewGui(gocui.OutputNormal)
 
@@ -80,36 +131,24 @@ func initGui(m *mic1) (*TUI, error) {
 	/* Translate all the binary microcode instructions to a human readable format */
 	for i, v := range u.Mic.MCC {
 		if v != nil {
-			u.MC[i] = v.ToString()
+			u.MC[i] = v.LabelString()
 		}
 	}
 	u.Gui.SetManagerFunc(u.Layout)
+	/* Esc closes the prompt rather than starting an Alt key */
+	u.Gui.InputEsc = true
 
 	/* Keybindings */
-	var keys []KeyBinding = []KeyBinding{
-		KeyBinding{"", gocui.KeyCtrlC, gocui.ModNone, quit},
-		KeyBinding{"", 'q', gocui.ModNone, quit},
-		KeyBinding{"", 's', gocui.ModNone, u.MicStep},
-		KeyBinding{"", 'r', gocui.ModNone, u.MicRun},
-		KeyBinding{"", 'h', gocui.ModNone, u.MicHalt},
-		KeyBinding{"", 'c', gocui.ModNone, u.CycleView},
-		KeyBinding{"", 'C', gocui.ModNone, u.ReverseCycleView},
-		KeyBinding{"", 'l', gocui.ModNone, u.MicReset},
-		KeyBinding{"symbols", 'j', gocui.ModNone, u.SymScrollDown},
-		KeyBinding{"symbols", 'k', gocui.ModNone, u.SymScrollUp},
-		KeyBinding{"symbols", 'g', gocui.ModNone, u.SymGoto},
-		KeyBinding{"symbols", gocui.KeyEnter, gocui.ModNone, u.SymGoto},
-		KeyBinding{"symbols", 'm', gocui.ModNone, u.SymModeToggle},
-		KeyBinding{"memory", 'j', gocui.ModNone, u.MemScrollDown},
-		KeyBinding{"memory", 'k', gocui.ModNone, u.MemScrollUp},
-		KeyBinding{"memory", 'm', gocui.ModNone, u.MemModeToggle},
-		KeyBinding{"microcode", 'j', gocui.ModNone, u.MicrocodeScrollDown},
-		KeyBinding{"microcode", 'k', gocui.ModNone, u.MicrocodeScrollUp},
-		KeyBinding{"microcode", 'b', gocui.ModNone, u.MicrocodeToggleBreakPoint},
-	}
-
-	/* Setup keybindngs */
-	for _, k := range keys {
+	u.Keys = keys
+	if err = u.bindKeys(); err != nil {
+		return nil, err
+	}
+	/* The prompt's keys can't be remapped */
+	var fixed []KeyBinding = []KeyBinding{
+		KeyBinding{"prompt", gocui.KeyEnter, gocui.ModNone, u.PromptEnter},
+		KeyBinding{"prompt", gocui.KeyEsc, gocui.ModNone, u.PromptClose},
+	}
+	for _, k := range fixed {
 		err = u.Gui.SetKeybinding(k.View, k.Key, k.Mod, k.Handler)
 		if err != nil {
 			return nil, err
@@ -142,6 +181,21 @@ func (u *TUI) UpdateViews(g *gocui.Gui) error {
 	if err != nil {
 		return err
 	}
+	/* Source View */
+	err = u.UpdateSourceView(g)
+	if err != nil {
+		return err
+	}
+	/* Changes View */
+	err = u.UpdateChangesView(g)
+	if err != nil {
+		return err
+	}
+	/* Watches View */
+	err = u.UpdateWatchesView(g)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -153,16 +207,29 @@ func (u *TUI) UpdateRegistersView(g *gocui.Gui) error {
 		return err
 	}
 	v.Clear()
+	/* registers changed by the last step or run are highlighted */
 	for i, r := range u.Mic.Registers {
-		fmt.Fprintf(v, "%-7s: %#04x %-5d %016b\n", RegIdToNames[i], r, r, r)
-	}
-	fmt.Fprintf(v, "MAR    : %#04x %-5d %016b\n", u.Mic.MAR, u.Mic.MAR, u.Mic.MAR)
-	fmt.Fprintf(v, "MBR    : %#04x %-5d %016b\n", u.Mic.MBR, u.Mic.MBR, u.Mic.MBR)
-	if u.Mic.State == RUN {
-		fmt.Fprintf(v, "Status : Running\n")
+		fmt.Fprintf(v, "%-7s: %s\n", RegIdToNames[i], markChanged(fmt.Sprintf("%#04x %-5d %016b", r, r, r), u.Mic.RegChanged(i)))
+	}
+	fmt.Fprintf(v, "MAR    : %s\n", markChanged(fmt.Sprintf("%#04x %-5d %016b", u.Mic.MAR, u.Mic.MAR, u.Mic.MAR), u.Mic.RegChanged(CHANGE_MAR)))
+	fmt.Fprintf(v, "MBR    : %s\n", markChanged(fmt.Sprintf("%#04x %-5d %016b", u.Mic.MBR, u.Mic.MBR, u.Mic.MBR), u.Mic.RegChanged(CHANGE_MBR)))
+	v.Title = fmt.Sprintf("registers - animate %d/s", u.ClockRate)
+	if u.Mic.Running() && u.Mic.ClockRate() > 0 {
+		fmt.Fprintf(v, "Status : Animating")
+	} else if u.Mic.Running() {
+		fmt.Fprintf(v, "Status : Running")
+	} else if u.ReloadErr != nil {
+		fmt.Fprintf(v, "Status : Halted, reload failed: %s", u.ReloadErr)
+	} else if u.Mic.Fault != nil {
+		fmt.Fprintf(v, "Status : Halted, %s", u.Mic.Fault)
 	} else {
-		fmt.Fprintf(v, "Status : Halted\n")
+		fmt.Fprintf(v, "Status : Halted")
+	}
+	if n := u.Mic.ConstViolationCount; n > 0 {
+		last := u.Mic.ConstViolations[len(u.Mic.ConstViolations)-1]
+		fmt.Fprintf(v, " (%d RO writes, %s@%d)", n, RegIdToNames[last.Reg], last.MPC)
 	}
+	fmt.Fprint(v, "\n")
 	fmt.Fprintf(v, "MPC    : %d\n", u.Mic.MPC)
 	fmt.Fprintf(v, "Cycles : %d", u.Mic.Cycles)
 
@@ -176,15 +243,24 @@ func (u *TUI) UpdateSymbolsView(g *gocui.Gui) error {
 	}
 	v.Clear()
 	_, maxY := v.Size()
-	if u.SymHex {
-		for i := 0; i < maxY && (i+u.SymMin) < len(u.Mic.MemSymbols); i++ {
-			fmt.Fprintf(v, "%-24s : %#04x\n", u.Mic.MemSymbols[i+u.SymMin].Name, u.Mic.MemSymbols[i+u.SymMin].Val)
+	syms := u.Mic.MemSymbols
+	for i := 0; i < maxY && (i+u.SymMin) < len(syms); i++ {
+		sym := syms[i+u.SymMin]
+		size := ""
+		if sym.Size != 0 {
+			size = fmt.Sprintf("%d", sym.Size)
 		}
-	} else {
-		for i := 0; i < maxY && (i+u.SymMin) < len(u.Mic.MemSymbols); i++ {
-			fmt.Fprintf(v, "%-24s : %-6d\n", u.Mic.MemSymbols[i+u.SymMin].Name, u.Mic.MemSymbols[i+u.SymMin].Val)
+		if u.SymHex {
+			fmt.Fprintf(v, "%-20s : %#04x %-4s %4s\n", sym.Name, sym.Val, SymKindNames[sym.Kind], size)
+		} else {
+			fmt.Fprintf(v, "%-20s : %-6d %-4s %4s\n", sym.Name, sym.Val, SymKindNames[sym.Kind], size)
 		}
 	}
+	/* the selected symbol's source location */
+	v.Title = "symbols"
+	if u.SymPos < len(syms) && syms[u.SymPos].File != "" {
+		v.Title = fmt.Sprintf("symbols - %s:%d", syms[u.SymPos].File, syms[u.SymPos].Line)
+	}
 
 	return nil
 }
@@ -197,11 +273,17 @@ func (u *TUI) UpdateMicrocodeView(g *gocui.Gui) error {
 	u.Mic.RegistersLock.Lock()
 	mpc := u.Mic.MPC
 	u.Mic.RegistersLock.Unlock()
+	u.followMicrocode(v, int(mpc))
+	if u.MCFollow {
+		v.Title = "microcode - follow MPC"
+	} else {
+		v.Title = "microcode"
+	}
 	v.Clear()
 	_, maxY := v.Size()
 	var br rune
 	var cur rune
-	for i := 0; u.Mic.MCC[i+u.MCMin] != nil && i < maxY && (i+u.MCMin) < 256; i++ {
+	for i := 0; i < maxY && i+u.MCMin < 256 && u.Mic.MCC[i+u.MCMin] != nil; i++ {
 		if i+u.MCMin == int(mpc) {
 			cur = '>'
 		} else {
@@ -224,25 +306,41 @@ func (u *TUI) UpdateMemoryView(g *gocui.Gui) error {
 	if err != nil {
 		return err
 	}
+	u.followMemory(v)
+	v.Title = u.memTitle()
 	v.Clear()
 	_, maxY := v.Size()
-	if u.MemHex {
-		for i := 0; i < maxY && (i*8+int(u.MemMin)) < 4096; i++ {
-			fmt.Fprintf(v, "%#04x: ", int(u.MemMin)+(i*8))
-			for j := 0; j < 8; j++ {
-				fmt.Fprintf(v, "%#04x ", u.Mic.Memory[int(u.MemMin)+(i*8)+j])
-			}
-			fmt.Fprint(v, "\n")
+	sel := u.MemSelected()
+	for i := 0; i < maxY && (i*8+int(u.MemMin)) < 4096; i++ {
+		row := int(u.MemMin) + (i * 8)
+		if u.MemHex {
+			fmt.Fprintf(v, "%#04x:", row)
+		} else {
+			fmt.Fprintf(v, "%6d:", row)
 		}
-	} else {
-		for i := 0; i < maxY && (i*8+int(u.MemMin)) < 4096; i++ {
-			fmt.Fprintf(v, "%6d: ", int(u.MemMin)+(i*8))
-			for j := 0; j < 8; j++ {
-				fmt.Fprintf(v, "%6d ", u.Mic.Memory[int(u.MemMin)+(i*8)+j])
+		/* the selected word is shown in brackets */
+		for j := 0; j < 8; j++ {
+			sep := ' '
+			if row+j == sel {
+				sep = '['
+			} else if row+j == sel+1 && j != 0 {
+				sep = ']'
+			}
+			mark := u.memMarker(row + j)
+			end := ""
+			if mark != "" {
+				end = MARK_END
+			}
+			if u.MemHex {
+				fmt.Fprintf(v, "%c%s%#04x%s", sep, mark, u.Mic.Memory[row+j], end)
+			} else {
+				fmt.Fprintf(v, "%c%s%6d%s", sep, mark, u.Mic.Memory[row+j], end)
 			}
-			fmt.Fprint(v, "\n")
 		}
-
+		if row+7 == sel {
+			fmt.Fprint(v, "]")
+		}
+		fmt.Fprint(v, "\n")
 	}
 
 	return nil
@@ -265,9 +363,16 @@ func (u *TUI) Layout(g *gocui.Gui) error {
 			return err
 		}
 		v.Frame = true
+		v.Highlight = true
 		v.Title = "registers"
+		v.SetCursor(0, 0)
+		DefocusView(g, v)
+
+		u.VCycle = append(u.VCycle, v)
 	}
-	if v, err := g.SetView("symbols", 0, cell1y+1, col1x, maxY); err != nil {
+	/* symbols share the space under the registers with watches */
+	watchy := cell1y + (maxY-cell1y)/2
+	if v, err := g.SetView("symbols", 0, cell1y+1, col1x, watchy); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
@@ -279,7 +384,25 @@ func (u *TUI) Layout(g *gocui.Gui) error {
 
 		u.VCycle = append(u.VCycle, v)
 	}
-	if v, err := g.SetView("microcode", col1x+1, 0, maxX, (maxY-4)/2); err != nil {
+	if u.ShowChanges {
+		if v, err := g.SetView("changes", 0, cell1y+1, col1x, watchy); err != nil {
+			if err != gocui.ErrUnknownView {
+				return err
+			}
+			v.Frame = true
+			v.Title = "changes"
+		}
+	} else {
+		g.DeleteView("changes")
+	}
+	/* with a line map the source frame goes between microcode and memory */
+	mcy := (maxY - 4) / 2
+	srcy := mcy
+	if u.Mic.HasSource() {
+		mcy = (maxY - 4) / 3
+		srcy = mcy * 2
+	}
+	if v, err := g.SetView("microcode", col1x+1, 0, maxX, mcy); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
@@ -292,7 +415,22 @@ func (u *TUI) Layout(g *gocui.Gui) error {
 
 		u.VCycle = append(u.VCycle, v)
 	}
-	if v, err := g.SetView("memory", col1x+1, (maxY-4)/2+1, maxX, maxY); err != nil {
+	if u.Mic.HasSource() {
+		if v, err := g.SetView("source", col1x+1, mcy+1, maxX, srcy); err != nil {
+			if err != gocui.ErrUnknownView {
+				return err
+			}
+			v.Frame = true
+			v.Highlight = true
+			v.Title = "source"
+
+			v.SetCursor(0, 0)
+			DefocusView(g, v)
+
+			u.VCycle = append(u.VCycle, v)
+		}
+	}
+	if v, err := g.SetView("memory", col1x+1, srcy+1, maxX, maxY); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
@@ -305,6 +443,19 @@ func (u *TUI) Layout(g *gocui.Gui) error {
 
 		u.VCycle = append(u.VCycle, v)
 	}
+	if v, err := g.SetView("watches", 0, watchy+1, col1x, maxY); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Frame = true
+		v.Highlight = true
+		v.Title = "watches"
+
+		v.SetCursor(0, 0)
+		DefocusView(g, v)
+
+		u.VCycle = append(u.VCycle, v)
+	}
 	u.UpdateViews(g)
 	return nil
 }
@@ -314,6 +465,10 @@ func quit(g *gocui.Gui, v *gocui.View) error {
 }
 
 func (u *TUI) MicStep(g *gocui.Gui, v *gocui.View) error {
+	if u.Mic.Running() {
+		return nil
+	}
+	u.Mic.ClearChanges()
 	u.Mic.Step()
 	//g.Update(u.UpdateViews)
 	return nil
@@ -325,44 +480,79 @@ func (u *TUI) MicUpdate(g *gocui.Gui, v *gocui.View) error {
 }
 
 func (u *TUI) MicRun(g *gocui.Gui, v *gocui.View) error {
-	u.Mic.DesiredState = RUN
+	u.Mic.SetClockRate(0)
+	if u.Mic.Running() {
+		return nil
+	}
+	u.Mic.ClearChanges()
+	u.Mic.Start(context.Background(), nil)
 	u.Gui.Update(u.UpdateViews)
-	go u.Mic.Run()
-	go u.MicWatcher()
 	return nil
 }
 
 func (u *TUI) MicHalt(g *gocui.Gui, v *gocui.View) error {
-	u.Mic.DesiredState = HALT
+	u.Mic.Halt()
 	return nil
 }
 
+/*
+ * Halts the machine and reloads it once the run has stopped. The UI goroutine
+ * must not wait for the run, as the run may be waiting on it to draw.
+ */
 func (u *TUI) MicReset(g *gocui.Gui, v *gocui.View) error {
-	u.Mic.DesiredState = HALT
-	for newState := range u.Mic.StateChanges {
-		if newState == HALT {
-			break
-		}
-	}
-	u.Mic.Reset()
-	u.Mic.ZeroMem()
-	u.Mic.ZeroMC()
-	u.MCR(u.Mic)
-	u.MR(u.Mic)
+	u.Mic.Halt()
+	go func() {
+		u.Mic.Wait()
+		u.Gui.Update(u.reload)
+	}()
+	return nil
+}
+
+func (u *TUI) reload(g *gocui.Gui) error {
+	u.ReloadErr = u.Mic.Reload(u.loadFiles)
+	u.Mic.ClearChanges()
 	u.MC = make([]string, 256, 256)
 	/* Translate all the binary microcode instructions to a human readable format */
 	for i, v := range u.Mic.MCC {
 		if v != nil {
-			u.MC[i] = v.ToString()
+			u.MC[i] = v.LabelString()
 		}
 	}
-	u.Gui.Update(u.UpdateViews)
+	return u.UpdateViews(g)
+}
 
+/* Resets the registers and loads the files again, as the CLI's reset does */
+func (u *TUI) loadFiles(m *mic1) error {
+	breaks := make([]int, 0)
+	for i, v := range m.MCC {
+		if v != nil && v.BR {
+			breaks = append(breaks, i)
+		}
+	}
+	m.resetRegisters()
+	if u.MCR != nil {
+		m.ZeroMC()
+		if err := u.MCR(m); err != nil {
+			return err
+		}
+	}
+	if u.MR != nil {
+		m.ZeroMem()
+		if err := u.MR(m); err != nil {
+			return err
+		}
+		m.TakeSnapshot(LOADED_SNAPSHOT)
+	}
+	/* reloading the microcode drops microcode breakpoints */
+	for _, i := range breaks {
+		m.SetMCBreak(i, true)
+	}
 	return nil
 }
 
-func (u *TUI) MicWatcher() {
-	for newState := range u.Mic.StateChanges {
+/* Redraws the views whenever a run stops */
+func (u *TUI) MicWatcher(states <-chan int) {
+	for newState := range states {
 		if newState == HALT {
 			u.Gui.Update(u.UpdateViews)
 		}
@@ -444,12 +634,8 @@ func (u *TUI) MemScrollUp(g *gocui.Gui, v *gocui.View) error {
 
 func (u *TUI) MicrocodeScrollDown(g *gocui.Gui, v *gocui.View) error {
 	_, y := v.Size()
-	u.MCPos++
-	if u.Mic.MCC[u.MCPos] == nil {
-		u.MCPos--
-	}
-	if u.MCPos > 255 {
-		u.MCPos = 255
+	if u.MCPos < 255 && u.Mic.MCC[u.MCPos+1] != nil {
+		u.MCPos++
 	}
 	if u.MCPos >= u.MCMin+y {
 		u.MCMin++
@@ -473,17 +659,12 @@ func (u *TUI) MicrocodeScrollUp(g *gocui.Gui, v *gocui.View) error {
 }
 
 func (u *TUI) SymGoto(g *gocui.Gui, v *gocui.View) error {
-	v2, err := g.View("memory")
-	if err != nil {
-		return err
-	}
 	_, symi := v.Cursor()
 	symi += u.SymMin
-	sym := u.Mic.MemSymbols[symi].Val
-	u.MemAddr = int(sym - (sym % 8))
-	u.MemMin = u.MemAddr
-	v2.SetCursor(0, 0)
-	return nil
+	if symi >= len(u.Mic.MemSymbols) {
+		return nil
+	}
+	return u.MemShow(int(u.Mic.MemSymbols[symi].Val))
 }
 
 func (u *TUI) MemModeToggle(g *gocui.Gui, v *gocui.View) error {
@@ -501,8 +682,8 @@ func (u *TUI) MicrocodeToggleBreakPoint(g *gocui.Gui, v *gocui.View) error {
 	defer u.Mic.RegistersLock.Unlock()
 	_, mci := v.Cursor()
 	mci += u.MCMin
-	if u.Mic.MCC[mci] != nil {
-		u.Mic.MCC[mci].BR = !u.Mic.MCC[mci].BR
+	if mci < 256 && u.Mic.MCC[mci] != nil {
+		u.Mic.SetMCBreak(mci, !u.Mic.MCC[mci].BR)
 	}
 	return nil
 }
@@ -0,0 +1,106 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * Animate mode runs the machine at a chosen number of cycles per second and
+ * redraws the frames as it goes, so the microcode and memory frames show the
+ * MPC and PC moving. The speed can be changed while it runs.
+ */
+
+/* Clock rates the faster and slower keys step through, in cycles per second */
+var ClockRates = []int{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+const CLOCK_DEFAULT = 10
+
+/* Time between checks for a new frame while animating */
+const ANIMATE_FRAME = 20 * time.Millisecond
+
+/* Runs the machine at the animate clock rate, or switches a run in progress to it */
+func (u *TUI) MicAnimate(g *gocui.Gui, v *gocui.View) error {
+	u.Mic.SetClockRate(u.ClockRate)
+	if u.Mic.Running() {
+		return nil
+	}
+	u.Mic.ClearChanges()
+	u.Mic.Start(context.Background(), nil)
+	u.Gui.Update(u.UpdateViews)
+	return nil
+}
+
+func (u *TUI) ClockFaster(g *gocui.Gui, v *gocui.View) error {
+	for _, r := range ClockRates {
+		if r > u.ClockRate {
+			u.setClockRate(r)
+			break
+		}
+	}
+	return nil
+}
+
+func (u *TUI) ClockSlower(g *gocui.Gui, v *gocui.View) error {
+	for i := len(ClockRates) - 1; i >= 0; i-- {
+		if ClockRates[i] < u.ClockRate {
+			u.setClockRate(ClockRates[i])
+			break
+		}
+	}
+	return nil
+}
+
+/* Changes the animate rate, and the machine's when it is animating */
+func (u *TUI) setClockRate(hz int) {
+	u.ClockRate = hz
+	if u.Mic.ClockRate() > 0 {
+		u.Mic.SetClockRate(hz)
+	}
+	u.Gui.Update(u.UpdateRegistersView)
+}
+
+/*
+ * Redraws the frames whenever an animated run has executed more cycles. The
+ * changes are cleared after every frame so each frame highlights only what
+ * changed since the last one.
+ */
+func (u *TUI) AnimateFrames() {
+	var last uint64
+	for {
+		time.Sleep(ANIMATE_FRAME)
+		if !u.Mic.Running() || u.Mic.ClockRate() == 0 {
+			continue
+		}
+		u.Mic.RegistersLock.Lock()
+		cycles := u.Mic.Cycles
+		u.Mic.RegistersLock.Unlock()
+		if cycles == last {
+			continue
+		}
+		last = cycles
+		u.Gui.Update(func(g *gocui.Gui) error {
+			err := u.UpdateViews(g)
+			u.Mic.ClearChanges()
+			return err
+		})
+	}
+}
@@ -0,0 +1,238 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * Editing memory and registers from the TUI. Values are typed into a one
+ * line prompt and evaluated as expressions, so 0x1F, 31, 0b11111, 'A', -1
+ * and names like SP+1 all work.
+ */
+
+/* Number of register view rows that can be edited: the registers, MAR and MBR */
+var TUI_EDIT_REGS = len(RegIdToNames) + 2
+
+/* Opens a prompt, done is called with the text when enter is pressed */
+func (u *TUI) Prompt(title string, text string, done func(string) error) error {
+	g := u.Gui
+	maxX, maxY := g.Size()
+	w := 60
+	if w > maxX-2 {
+		w = maxX - 2
+	}
+	x0 := (maxX - w) / 2
+	y0 := maxY/2 - 1
+	v, err := g.SetView("prompt", x0, y0, x0+w, y0+2)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	v.Frame = true
+	v.Editable = true
+	v.Title = title
+	v.Clear()
+	v.SetCursor(0, 0)
+	for _, r := range text {
+		v.EditWrite(r)
+	}
+	u.PromptTitle = title
+	u.PromptDone = done
+	g.Cursor = true
+	_, err = g.SetCurrentView("prompt")
+	return err
+}
+
+func (u *TUI) PromptEnter(g *gocui.Gui, v *gocui.View) error {
+	text := strings.TrimSpace(v.Buffer())
+	if err := u.PromptDone(text); err != nil {
+		v.Title = err.Error() + " | " + u.PromptTitle
+		return nil
+	}
+	g.Update(u.UpdateViews)
+	return u.PromptClose(g, v)
+}
+
+func (u *TUI) PromptClose(g *gocui.Gui, v *gocui.View) error {
+	g.Cursor = false
+	u.PromptDone = nil
+	if err := g.DeleteView("prompt"); err != nil {
+		return err
+	}
+	FocusView(g, u.VCycle[u.CView])
+	return nil
+}
+
+/*
+ * Calls edit with the machine locked, so the values it evaluates are the ones
+ * it writes over, and refuses while the machine is running.
+ */
+func (u *TUI) locked(edit func(m *mic1) error) error {
+	if u.Mic.Running() {
+		return ErrRunning
+	}
+	u.Mic.RegistersLock.Lock()
+	defer u.Mic.RegistersLock.Unlock()
+	return edit(u.Mic)
+}
+
+/* Evaluates a list of comma separated expressions, the machine must be locked */
+func (u *TUI) evalArgs(s string, n int) ([]uint16, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, errors.New(fmt.Sprintf("expected %d comma separated values", n))
+	}
+	ret := make([]uint16, n)
+	for i, p := range parts {
+		v, err := u.Mic.Eval(p)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+/* Address of the selected memory word */
+func (u *TUI) MemSelected() int {
+	return u.MemAddr + u.MemCol
+}
+
+func (u *TUI) MemLeft(g *gocui.Gui, v *gocui.View) error {
+	if u.MemCol > 0 {
+		u.MemCol--
+	} else if u.MemAddr > 0 {
+		u.MemCol = 7
+		u.MemScrollUp(g, v)
+	}
+	u.Gui.Update(u.UpdateMemoryView)
+	return nil
+}
+
+func (u *TUI) MemRight(g *gocui.Gui, v *gocui.View) error {
+	if u.MemCol < 7 {
+		u.MemCol++
+	} else if u.MemAddr < 4088 {
+		u.MemCol = 0
+		u.MemScrollDown(g, v)
+	}
+	u.Gui.Update(u.UpdateMemoryView)
+	return nil
+}
+
+func (u *TUI) MemEdit(g *gocui.Gui, v *gocui.View) error {
+	addr := u.MemSelected()
+	u.Mic.RegistersLock.Lock()
+	cur := u.Mic.Memory[addr]
+	u.Mic.RegistersLock.Unlock()
+	title := fmt.Sprintf("mem[%#04x] = %#04x %d, new value", addr, cur, int16(cur))
+	return u.Prompt(title, "", func(s string) error {
+		return u.locked(func(m *mic1) error {
+			val, err := m.Eval(s)
+			if err != nil {
+				return err
+			}
+			m.Memory[addr] = val
+			return nil
+		})
+	})
+}
+
+func (u *TUI) MemFill(g *gocui.Gui, v *gocui.View) error {
+	text := fmt.Sprintf("%#04x, ", u.MemSelected())
+	return u.Prompt("fill: start, count, value", text, func(s string) error {
+		return u.locked(func(m *mic1) error {
+			args, err := u.evalArgs(s, 3)
+			if err != nil {
+				return err
+			}
+			start, count := int(args[0]), int(args[1])
+			if start+count > len(m.Memory) {
+				return errors.New("range runs past the end of memory")
+			}
+			for i := start; i < start+count; i++ {
+				m.Memory[i] = args[2]
+			}
+			return nil
+		})
+	})
+}
+
+func (u *TUI) MemCopy(g *gocui.Gui, v *gocui.View) error {
+	text := fmt.Sprintf("%#04x, ", u.MemSelected())
+	return u.Prompt("copy: source, destination, count", text, func(s string) error {
+		return u.locked(func(m *mic1) error {
+			args, err := u.evalArgs(s, 3)
+			if err != nil {
+				return err
+			}
+			src, dst, count := int(args[0]), int(args[1]), int(args[2])
+			if src+count > len(m.Memory) || dst+count > len(m.Memory) {
+				return errors.New("range runs past the end of memory")
+			}
+			/* copy handles overlapping ranges */
+			copy(m.Memory[dst:dst+count], m.Memory[src:src+count])
+			return nil
+		})
+	})
+}
+
+func (u *TUI) RegScrollDown(g *gocui.Gui, v *gocui.View) error {
+	if u.RegPos < TUI_EDIT_REGS-1 {
+		u.RegPos++
+	}
+	v.SetCursor(0, u.RegPos)
+	return nil
+}
+
+func (u *TUI) RegScrollUp(g *gocui.Gui, v *gocui.View) error {
+	if u.RegPos > 0 {
+		u.RegPos--
+	}
+	v.SetCursor(0, u.RegPos)
+	return nil
+}
+
+func (u *TUI) RegEdit(g *gocui.Gui, v *gocui.View) error {
+	var name string
+	if u.RegPos < len(RegIdToNames) {
+		name = RegIdToNames[u.RegPos]
+	} else if u.RegPos == len(RegIdToNames) {
+		name = "MAR"
+	} else {
+		name = "MBR"
+	}
+	u.Mic.RegistersLock.Lock()
+	cur, _ := u.Mic.Register(name)
+	u.Mic.RegistersLock.Unlock()
+	title := fmt.Sprintf("%s = %#04x %d, new value", name, cur, int16(cur))
+	return u.Prompt(title, "", func(s string) error {
+		return u.locked(func(m *mic1) error {
+			val, err := m.Eval(s)
+			if err != nil {
+				return err
+			}
+			m.SetRegister(name, val)
+			return nil
+		})
+	})
+}
@@ -0,0 +1,143 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"fmt"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * Follow modes scroll a frame when the followed address changes so it stays
+ * visible. Between changes the frame can be scrolled freely.
+ */
+
+const (
+	FOLLOW_NONE = iota
+	FOLLOW_PC
+	FOLLOW_SP
+	FOLLOW_ACCESS
+)
+
+var FollowNames = []string{"", "follow PC", "follow SP", "follow last access"}
+
+/* Colours of the PC, SP and MAR markers in the memory frame */
+const (
+	MARK_PC  = "\x1b[32m"
+	MARK_SP  = "\x1b[36m"
+	MARK_MAR = "\x1b[35m"
+	MARK_END = "\x1b[0m"
+)
+
+func (u *TUI) MemFollowToggle(g *gocui.Gui, v *gocui.View) error {
+	u.MemFollow = (u.MemFollow + 1) % len(FollowNames)
+	u.MemFollowed = -1
+	u.Gui.Update(u.UpdateMemoryView)
+	return nil
+}
+
+func (u *TUI) MicrocodeFollowToggle(g *gocui.Gui, v *gocui.View) error {
+	u.MCFollow = !u.MCFollow
+	u.MCFollowed = -1
+	u.Gui.Update(u.UpdateMicrocodeView)
+	return nil
+}
+
+/* Address the memory frame follows, the machine must be locked */
+func (u *TUI) memFollowAddr() (int, bool) {
+	m := u.Mic
+	switch u.MemFollow {
+	case FOLLOW_PC:
+		return int(m.Registers[REG_PC] & 0x0FFF), true
+	case FOLLOW_SP:
+		return int(m.Registers[REG_SP] & 0x0FFF), true
+	case FOLLOW_ACCESS:
+		a, ok := m.LastAccess()
+		return int(a & 0x0FFF), ok
+	}
+	return 0, false
+}
+
+/* Scrolls the memory frame to the followed address when it has changed */
+func (u *TUI) followMemory(v *gocui.View) {
+	addr, ok := u.memFollowAddr()
+	if !ok || addr == u.MemFollowed {
+		return
+	}
+	u.MemFollowed = addr
+	_, y := v.Size()
+	u.MemAddr = addr - addr%8
+	u.MemCol = addr % 8
+	if u.MemAddr < u.MemMin || u.MemAddr >= u.MemMin+y*8 {
+		u.MemMin = u.MemAddr
+	}
+	v.SetCursor(0, (u.MemAddr-u.MemMin)/8)
+}
+
+/* Scrolls the microcode frame to MPC when it has changed */
+func (u *TUI) followMicrocode(v *gocui.View, mpc int) {
+	if !u.MCFollow || mpc == u.MCFollowed {
+		return
+	}
+	u.MCFollowed = mpc
+	_, y := v.Size()
+	if mpc < u.MCMin || mpc >= u.MCMin+y {
+		u.MCMin = mpc - y/2
+		if u.MCMin > len(u.Mic.MCC)-y {
+			u.MCMin = len(u.Mic.MCC) - y
+		}
+		if u.MCMin < 0 {
+			u.MCMin = 0
+		}
+	}
+	/* keep the cursor on the screen */
+	if u.MCPos < u.MCMin {
+		u.MCPos = u.MCMin
+	} else if u.MCPos >= u.MCMin+y {
+		u.MCPos = u.MCMin + y - 1
+	}
+	v.SetCursor(0, u.MCPos-u.MCMin)
+}
+
+/* Returns the colour marking addr in the memory frame, PC wins over SP, SP over changed words and those over MAR */
+func (u *TUI) memMarker(addr int) string {
+	m := u.Mic
+	switch {
+	case addr == int(m.Registers[REG_PC]&0x0FFF):
+		return MARK_PC
+	case addr == int(m.Registers[REG_SP]&0x0FFF):
+		return MARK_SP
+	case m.MemChanged(uint16(addr)):
+		return MARK_CHANGED
+	case addr == int(m.MAR&0x0FFF):
+		return MARK_MAR
+	}
+	return ""
+}
+
+func (u *TUI) memTitle() string {
+	m := u.Mic
+	t := fmt.Sprintf("memory - PC %#04x SP %#04x MAR %#04x", m.Registers[REG_PC]&0x0FFF, m.Registers[REG_SP]&0x0FFF, m.MAR&0x0FFF)
+	if u.MemFollow != FOLLOW_NONE {
+		t += " - " + FollowNames[u.MemFollow]
+	}
+	if u.SearchStatus != "" {
+		t += " - " + u.SearchStatus
+	}
+	return t
+}
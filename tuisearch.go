@@ -0,0 +1,192 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * Go-to and search for the TUI memory frame. A search is one of
+ *   expression          a word equal to the value
+ *   value, mask         a word equal to value in the bits set in mask
+ *   0b01xx...           a bit pattern where x matches either bit
+ *   "text"              consecutive words holding the characters
+ */
+
+type SearchWord struct {
+	Val  uint16
+	Mask uint16
+}
+
+/* Selects the word at addr and scrolls the memory frame to show it */
+func (u *TUI) MemShow(addr int) error {
+	v, err := u.Gui.View("memory")
+	if err != nil {
+		return err
+	}
+	_, y := v.Size()
+	u.MemAddr = addr - addr%8
+	u.MemCol = addr % 8
+	if u.MemAddr < u.MemMin || u.MemAddr >= u.MemMin+y*8 {
+		u.MemMin = u.MemAddr
+	}
+	v.SetCursor(0, (u.MemAddr-u.MemMin)/8)
+	u.Gui.Update(u.UpdateMemoryView)
+	return nil
+}
+
+func (u *TUI) MemGoto(g *gocui.Gui, v *gocui.View) error {
+	return u.Prompt("go to address, symbol or register", "", func(s string) error {
+		u.Mic.RegistersLock.Lock()
+		addr, err := u.Mic.Eval(s)
+		u.Mic.RegistersLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if int(addr) >= len(u.Mic.Memory) {
+			return errors.New(fmt.Sprintf("address %d is outside of memory", addr))
+		}
+		return u.MemShow(int(addr))
+	})
+}
+
+/* Parses a search into the words to match */
+func (u *TUI) ParseSearch(s string) ([]SearchWord, error) {
+	if strings.HasPrefix(s, "\"") {
+		text := strings.TrimSuffix(s[1:], "\"")
+		if text == "" {
+			return nil, errors.New("empty search string")
+		}
+		pat := make([]SearchWord, 0, len(text))
+		for _, c := range text {
+			pat = append(pat, SearchWord{uint16(c), 0xFFFF})
+		}
+		return pat, nil
+	}
+	if strings.HasPrefix(s, "0b") && strings.ContainsAny(s, "xX") {
+		bits := s[2:]
+		if len(bits) > 16 {
+			return nil, errors.New("bit patterns can be at most 16 bits")
+		}
+		var w SearchWord
+		for _, c := range bits {
+			w.Val <<= 1
+			w.Mask <<= 1
+			switch c {
+			case '0':
+				w.Mask |= 1
+			case '1':
+				w.Val |= 1
+				w.Mask |= 1
+			case 'x', 'X':
+			default:
+				return nil, errors.New(fmt.Sprintf("bad bit \"%c\" in pattern, use 0, 1 or x", c))
+			}
+		}
+		return []SearchWord{w}, nil
+	}
+	args := strings.Split(s, ",")
+	if len(args) > 2 {
+		return nil, errors.New("use value or value, mask")
+	}
+	w := SearchWord{Mask: 0xFFFF}
+	var err error
+	u.Mic.RegistersLock.Lock()
+	defer u.Mic.RegistersLock.Unlock()
+	if w.Val, err = u.Mic.Eval(args[0]); err != nil {
+		return nil, err
+	}
+	if len(args) == 2 {
+		if w.Mask, err = u.Mic.Eval(args[1]); err != nil {
+			return nil, err
+		}
+		w.Val &= w.Mask
+	}
+	return []SearchWord{w}, nil
+}
+
+/* Returns the next match after (or before when dir is -1) from, wrapping around, or -1 */
+func (u *TUI) FindMatch(pat []SearchWord, from int, dir int) int {
+	m := u.Mic
+	m.RegistersLock.Lock()
+	defer m.RegistersLock.Unlock()
+	size := len(m.Memory)
+	for i := 1; i <= size; i++ {
+		a := ((from+dir*i)%size + size) % size
+		if a+len(pat) > size {
+			continue
+		}
+		found := true
+		for j, w := range pat {
+			if m.Memory[a+j]&w.Mask != w.Val {
+				found = false
+				break
+			}
+		}
+		if found {
+			return a
+		}
+	}
+	return -1
+}
+
+/* Moves to the next match in the given direction and reports it in the memory frame's title */
+func (u *TUI) searchStep(dir int) error {
+	if u.Search == nil {
+		return nil
+	}
+	a := u.FindMatch(u.Search, u.MemSelected(), dir)
+	if a < 0 {
+		u.SearchStatus = fmt.Sprintf("no match for %s", u.SearchText)
+		u.Gui.Update(u.UpdateMemoryView)
+		return nil
+	}
+	u.SearchStatus = fmt.Sprintf("%s at %#04x", u.SearchText, a)
+	return u.MemShow(a)
+}
+
+func (u *TUI) MemSearch(g *gocui.Gui, v *gocui.View) error {
+	return u.Prompt("search: value, value, mask, 0b01x pattern or \"text\"", "", func(s string) error {
+		/* an empty search repeats the last one */
+		if s == "" {
+			s = u.SearchText
+		}
+		pat, err := u.ParseSearch(s)
+		if err != nil {
+			return err
+		}
+		if u.FindMatch(pat, u.MemSelected(), 1) < 0 {
+			return errors.New("no match")
+		}
+		u.Search = pat
+		u.SearchText = s
+		return u.searchStep(1)
+	})
+}
+
+func (u *TUI) MemSearchNext(g *gocui.Gui, v *gocui.View) error {
+	return u.searchStep(1)
+}
+
+func (u *TUI) MemSearchPrev(g *gocui.Gui, v *gocui.View) error {
+	return u.searchStep(-1)
+}
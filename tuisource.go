@@ -0,0 +1,156 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * The source frame shows the assembly source of the PC's line when a line
+ * map is loaded. It follows the PC into other files and marks lines that
+ * have breakpoints.
+ */
+
+func (u *TUI) UpdateSourceView(g *gocui.Gui) error {
+	v, err := g.View("source")
+	if err != nil {
+		/* there is only a source frame when a line map is loaded */
+		return nil
+	}
+	u.Mic.RegistersLock.Lock()
+	pc, ok := u.Mic.SourceFor(u.Mic.CurrentPC())
+	u.Mic.RegistersLock.Unlock()
+	u.followSource(v, pc, ok)
+	v.Clear()
+	if u.SrcFile == "" {
+		v.Title = "source"
+		return nil
+	}
+	v.Title = "source - " + filepath.Base(u.SrcFile)
+	if u.SrcFollow {
+		v.Title += " - follow PC"
+	}
+	lines := u.Mic.SourceLines(u.SrcFile)
+	brk := u.Mic.SourceBreaks(u.SrcFile)
+	_, maxY := v.Size()
+	for i := 0; i < maxY && i+u.SrcMin < len(lines); i++ {
+		n := i + u.SrcMin + 1
+		br := ' '
+		if brk[n] {
+			br = '*'
+		}
+		if ok && pc.File == u.SrcFile && pc.Line == n {
+			fmt.Fprintf(v, ">%c%4d  %s%s%s\n", br, n, MARK_PC, lines[n-1], MARK_END)
+		} else {
+			fmt.Fprintf(v, " %c%4d  %s\n", br, n, lines[n-1])
+		}
+	}
+	return nil
+}
+
+/* Shows the PC's file and scrolls to its line when it has changed */
+func (u *TUI) followSource(v *gocui.View, pc SourceLoc, ok bool) {
+	if u.SrcFile == "" {
+		/* start on the first file in the line map */
+		for _, l := range u.Mic.LineMap {
+			if u.SrcFile == "" || l.File < u.SrcFile {
+				u.SrcFile = l.File
+			}
+		}
+	}
+	if !u.SrcFollow || !ok || pc == u.SrcFollowed {
+		return
+	}
+	u.SrcFollowed = pc
+	u.SrcFile = pc.File
+	_, y := v.Size()
+	line := pc.Line - 1
+	if line < u.SrcMin || line >= u.SrcMin+y {
+		u.SrcMin = line - y/2
+		if u.SrcMin < 0 {
+			u.SrcMin = 0
+		}
+	}
+	u.SrcPos = line
+	v.SetCursor(0, u.SrcPos-u.SrcMin)
+}
+
+func (u *TUI) SourceScrollDown(g *gocui.Gui, v *gocui.View) error {
+	_, y := v.Size()
+	u.SrcPos++
+	if n := len(u.Mic.SourceLines(u.SrcFile)); u.SrcPos >= n {
+		u.SrcPos = n - 1
+	}
+	if u.SrcPos < 0 {
+		u.SrcPos = 0
+	}
+	if u.SrcPos >= u.SrcMin+y {
+		u.SrcMin++
+	}
+	v.SetCursor(0, u.SrcPos-u.SrcMin)
+	u.Gui.Update(u.UpdateSourceView)
+	return nil
+}
+
+func (u *TUI) SourceScrollUp(g *gocui.Gui, v *gocui.View) error {
+	u.SrcPos--
+	if u.SrcPos < 0 {
+		u.SrcPos = 0
+	}
+	if u.SrcPos < u.SrcMin {
+		u.SrcMin = u.SrcPos
+	}
+	v.SetCursor(0, u.SrcPos-u.SrcMin)
+	u.Gui.Update(u.UpdateSourceView)
+	return nil
+}
+
+func (u *TUI) SourceFollowToggle(g *gocui.Gui, v *gocui.View) error {
+	u.SrcFollow = !u.SrcFollow
+	u.SrcFollowed = SourceLoc{}
+	u.Gui.Update(u.UpdateSourceView)
+	return nil
+}
+
+/* Toggles a PC breakpoint on the cursor's line, or the next line after it with code */
+func (u *TUI) SourceToggleBreakPoint(g *gocui.Gui, v *gocui.View) error {
+	u.Mic.RegistersLock.Lock()
+	defer u.Mic.RegistersLock.Unlock()
+	a, ok := u.Mic.AddrForSource(u.SrcFile, u.SrcPos+1)
+	if !ok {
+		return nil
+	}
+	if u.Mic.IsPCBR(a) {
+		u.Mic.RemovePCBR(a)
+	} else {
+		u.Mic.AddPCBR(a)
+	}
+	u.Gui.Update(u.UpdateSourceView)
+	return nil
+}
+
+/* Runs until the PC reaches a different source line */
+func (u *TUI) MicStepLine(g *gocui.Gui, v *gocui.View) error {
+	if !u.Mic.HasSource() {
+		return nil
+	}
+	return u.runUntil((*mic1).StepLineCond)
+}
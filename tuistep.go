@@ -0,0 +1,78 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"context"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * Macro instruction stepping. Each of these runs the machine at full speed
+ * until a stop condition from macro.go is met, so breakpoints still stop it
+ * early.
+ */
+
+/* Runs until the condition made from the halted machine is met */
+func (u *TUI) runUntil(cond func(m *mic1) func(m *mic1) bool) error {
+	if u.Mic.Running() {
+		return nil
+	}
+	u.Mic.ClearChanges()
+	u.Mic.RegistersLock.Lock()
+	done := cond(u.Mic)
+	u.Mic.RegistersLock.Unlock()
+	u.Mic.SetClockRate(0)
+	u.Mic.Start(context.Background(), done)
+	u.Gui.Update(u.UpdateViews)
+	return nil
+}
+
+/* Runs to the next macro instruction fetch */
+func (u *TUI) MicStepInstruction(g *gocui.Gui, v *gocui.View) error {
+	return u.runUntil((*mic1).StepCond)
+}
+
+/* Steps one macro instruction, running a CALL until it returns */
+func (u *TUI) MicStepOver(g *gocui.Gui, v *gocui.View) error {
+	return u.runUntil((*mic1).StepOverCond)
+}
+
+/* Runs until the current routine's RETN */
+func (u *TUI) MicStepOut(g *gocui.Gui, v *gocui.View) error {
+	return u.runUntil((*mic1).StepOutCond)
+}
+
+/* Runs until the PC reaches the selected memory word */
+func (u *TUI) MemRunTo(g *gocui.Gui, v *gocui.View) error {
+	addr := uint16(u.MemSelected())
+	return u.runUntil(func(m *mic1) func(m *mic1) bool {
+		return m.RunToCond(addr)
+	})
+}
+
+/* Runs until the PC reaches the cursor's line, or the next line after it with code */
+func (u *TUI) SourceRunTo(g *gocui.Gui, v *gocui.View) error {
+	addr, ok := u.Mic.AddrForSource(u.SrcFile, u.SrcPos+1)
+	if !ok {
+		return nil
+	}
+	return u.runUntil(func(m *mic1) func(m *mic1) bool {
+		return m.RunToCond(addr)
+	})
+}
@@ -0,0 +1,135 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jroimartin/gocui"
+)
+
+/*
+ * The watches frame shows expressions added by the user, evaluated again
+ * whenever the frames are redrawn. Each watch has its own format.
+ */
+
+func (u *TUI) UpdateWatchesView(g *gocui.Gui) error {
+	v, err := g.View("watches")
+	if err != nil {
+		return err
+	}
+	v.Clear()
+	_, maxY := v.Size()
+	u.Mic.RegistersLock.Lock()
+	defer u.Mic.RegistersLock.Unlock()
+	for i := 0; i < maxY && i+u.WatchMin < len(u.Watches); i++ {
+		w := u.Watches[i+u.WatchMin]
+		fmt.Fprintf(v, "%-16s = %s\n", w, w.Value(u.Mic))
+	}
+	return nil
+}
+
+/* Returns the selected watch, nil when there aren't any */
+func (u *TUI) watchSelected() *Watch {
+	if u.WatchPos < 0 || u.WatchPos >= len(u.Watches) {
+		return nil
+	}
+	return u.Watches[u.WatchPos]
+}
+
+/* Moves the cursor to the selected watch after the list has changed */
+func (u *TUI) watchSetCursor(v *gocui.View) {
+	_, y := v.Size()
+	if u.WatchPos >= len(u.Watches) {
+		u.WatchPos = len(u.Watches) - 1
+	}
+	if u.WatchPos < 0 {
+		u.WatchPos = 0
+	}
+	if u.WatchPos < u.WatchMin {
+		u.WatchMin = u.WatchPos
+	}
+	if u.WatchPos >= u.WatchMin+y {
+		u.WatchMin = u.WatchPos - y + 1
+	}
+	v.SetCursor(0, u.WatchPos-u.WatchMin)
+}
+
+func (u *TUI) WatchScrollDown(g *gocui.Gui, v *gocui.View) error {
+	u.WatchPos++
+	u.watchSetCursor(v)
+	u.Gui.Update(u.UpdateWatchesView)
+	return nil
+}
+
+func (u *TUI) WatchScrollUp(g *gocui.Gui, v *gocui.View) error {
+	u.WatchPos--
+	u.watchSetCursor(v)
+	u.Gui.Update(u.UpdateWatchesView)
+	return nil
+}
+
+func (u *TUI) WatchAdd(g *gocui.Gui, v *gocui.View) error {
+	return u.Prompt("watch: [/f] expression or string(address, length)", "", func(s string) error {
+		w, err := ParseWatch(s)
+		if err != nil {
+			return err
+		}
+		u.Watches = append(u.Watches, w)
+		u.WatchPos = len(u.Watches) - 1
+		u.watchSetCursor(v)
+		return nil
+	})
+}
+
+func (u *TUI) WatchEdit(g *gocui.Gui, v *gocui.View) error {
+	sel := u.watchSelected()
+	if sel == nil {
+		return u.WatchAdd(g, v)
+	}
+	return u.Prompt("watch: [/f] expression or string(address, length)", sel.String(), func(s string) error {
+		w, err := ParseWatch(s)
+		if err != nil {
+			return err
+		}
+		if u.watchSelected() != sel {
+			return errors.New("the watch was removed")
+		}
+		u.Watches[u.WatchPos] = w
+		return nil
+	})
+}
+
+func (u *TUI) WatchDelete(g *gocui.Gui, v *gocui.View) error {
+	if u.watchSelected() == nil {
+		return nil
+	}
+	u.Watches = append(u.Watches[:u.WatchPos], u.Watches[u.WatchPos+1:]...)
+	u.watchSetCursor(v)
+	u.Gui.Update(u.UpdateWatchesView)
+	return nil
+}
+
+/* Cycles the selected watch's format */
+func (u *TUI) WatchModeToggle(g *gocui.Gui, v *gocui.View) error {
+	if w := u.watchSelected(); w != nil {
+		w.NextFormat()
+	}
+	u.Gui.Update(u.UpdateWatchesView)
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -27,13 +28,18 @@ import (
 )
 
 func LoadBinaryMCFile(fp string) ([]uint32, error) {
-	ret := make([]uint32, 0, 256)
-	buff, err := ioutil.ReadFile(fp)
+	img, err := LoadMCFile(fp, "mc")
 	if err != nil {
-		return ret, err
+		return make([]uint32, 0), err
 	}
+	return img.Words, nil
+}
+
+/* Parses big-endian 32 bit microcode words, name is only used in errors */
+func ParseBinaryMC(buff []byte, name string) ([]uint32, error) {
+	ret := make([]uint32, 0, 256)
 	if len(buff)%4 != 0 {
-		return ret, errors.New(fmt.Sprintf("Binary microcode file, \"%s\" is not a multiple of 4 bytes in length", fp))
+		return ret, errors.New(fmt.Sprintf("Binary microcode file, \"%s\" is not a multiple of 4 bytes in length", name))
 	}
 	for i := 0; i < len(buff); i += 4 {
 		var curWord uint32
@@ -50,17 +56,28 @@ func LoadBinaryMCFile(fp string) ([]uint32, error) {
 }
 
 func LoadBinaryStringMCFile(fp string) ([]uint32, error) {
-	ret := make([]uint32, 0, 256)
-	file, err := os.Open(fp)
+	img, err := LoadMCFile(fp, "mcs")
 	if err != nil {
-		return ret, err
+		return make([]uint32, 0), err
 	}
-	defer file.Close()
-	s := bufio.NewScanner(file)
+	return img.Words, nil
+}
 
-	for s.Scan() {
+/* Parses microcode words written as one binary string per line */
+func ParseBinaryStringMC(r io.Reader) ([]uint32, error) {
+	ret := make([]uint32, 0, 256)
+	s := bufio.NewScanner(r)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if !isBinaryWord(line) {
+			return ret, errors.New(fmt.Sprintf("line %d: \"%s\" is not a binary word", n, line))
+		}
 		var tmp uint32
-		fmt.Sscanf(s.Text(), "%b", &tmp)
+		fmt.Sscanf(line, "%b", &tmp)
 		ret = append(ret, tmp)
 	}
 	if err := s.Err(); err != nil {
@@ -71,13 +88,18 @@ func LoadBinaryStringMCFile(fp string) ([]uint32, error) {
 }
 
 func LoadBinaryMemFile(fp string) ([]uint16, error) {
-	ret := make([]uint16, 0, 4096)
 	buff, err := ioutil.ReadFile(fp)
 	if err != nil {
-		return ret, err
+		return make([]uint16, 0), err
 	}
+	return ParseBinaryMem(buff, fp)
+}
+
+/* Parses big-endian 16 bit memory words, name is only used in errors */
+func ParseBinaryMem(buff []byte, name string) ([]uint16, error) {
+	ret := make([]uint16, 0, 4096)
 	if len(buff)%2 != 0 {
-		return ret, errors.New(fmt.Sprintf("Binary memory file, \"%s\" is not a multiple of 2 bytes in length", fp))
+		return ret, errors.New(fmt.Sprintf("Binary memory file, \"%s\" is not a multiple of 2 bytes in length", name))
 	}
 	for i := 0; i < len(buff); i += 2 {
 		var curWord uint16
@@ -91,17 +113,25 @@ func LoadBinaryMemFile(fp string) ([]uint16, error) {
 }
 
 func LoadBinaryStringMemFile(fp string) ([]uint16, []Symbol, error) {
-	ret := make([]uint16, 0, 4096)
-	syms := make([]Symbol, 0, 0)
 	file, err := os.Open(fp)
 	if err != nil {
-		return ret, syms, err
+		return make([]uint16, 0), make([]Symbol, 0), err
 	}
 	defer file.Close()
-	s := bufio.NewScanner(file)
+	return ParseBinaryStringMem(file)
+}
+
+/* Parses memory words written as one binary string per line and "#name: value" symbol lines */
+func ParseBinaryStringMem(r io.Reader) ([]uint16, []Symbol, error) {
+	ret := make([]uint16, 0, 4096)
+	syms := make([]Symbol, 0, 0)
+	s := bufio.NewScanner(r)
 
 	for s.Scan() {
 		line := s.Text()
+		if len(line) == 0 {
+			continue
+		}
 		if line[0] != '#' {
 			var tmp uint16
 			fmt.Sscanf(line, "%b", &tmp)
@@ -0,0 +1,170 @@
+/* Copyright (C) 2019 David Jowett
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Watches are expressions shown again every time the machine steps or halts,
+ * in the watches frame of the TUI and after each stop in the CLI. They are
+ * written as
+ *   [/f] expression
+ *   [/f] string(address[, length])
+ * where f is one of the x, d, u, b, c or i formats and string shows memory
+ * words as characters up to the first zero word.
+ */
+
+/* Length of string(address) when it isn't given */
+const WATCH_STRING_LEN = 16
+
+/* Formats a watch cycles through, 0 is the default of signed decimal and hex */
+var WatchFormats = []byte{0, 'x', 'd', 'u', 'b', 'c', 'i'}
+
+type Watch struct {
+	Text   string
+	Format byte
+	X      Expr
+	/* Number of words shown as characters for string(), nil for a value */
+	Len Expr
+}
+
+func ParseWatch(s string) (*Watch, error) {
+	_, f, rest, err := cliFormat(strings.TrimSpace(s), 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watch{Text: rest, Format: f}
+	if strings.HasPrefix(rest, "string(") && strings.HasSuffix(rest, ")") {
+		args := splitExprArgs(rest[len("string(") : len(rest)-1])
+		if len(args) < 1 || len(args) > 2 {
+			return nil, errors.New("use string(address) or string(address, length)")
+		}
+		if w.X, err = ParseExpr(args[0]); err != nil {
+			return nil, err
+		}
+		w.Len = exprNum(WATCH_STRING_LEN)
+		if len(args) == 2 {
+			if w.Len, err = ParseExpr(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return w, nil
+	}
+	if w.X, err = ParseExpr(rest); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+/* Splits expressions on the commas that aren't inside brackets */
+func splitExprArgs(s string) []string {
+	ret := make([]string, 0)
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				ret = append(ret, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(ret, s[start:])
+}
+
+/* Returns the watch as it would be typed */
+func (w *Watch) String() string {
+	if w.Format == 0 {
+		return w.Text
+	}
+	return fmt.Sprintf("/%c %s", w.Format, w.Text)
+}
+
+/* Moves the watch on to the next format */
+func (w *Watch) NextFormat() {
+	for i, f := range WatchFormats {
+		if f == w.Format {
+			w.Format = WatchFormats[(i+1)%len(WatchFormats)]
+			return
+		}
+	}
+	w.Format = 0
+}
+
+/* Evaluates and formats the watch, errors are shown in place of the value, the machine must be locked */
+func (w *Watch) Value(m *mic1) string {
+	v, err := w.X.Eval(m)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	if w.Len != nil {
+		n, err := w.Len.Eval(m)
+		if err != nil {
+			return "<" + err.Error() + ">"
+		}
+		s, err := m.MemString(v, n)
+		if err != nil {
+			return "<" + err.Error() + ">"
+		}
+		return s
+	}
+	if w.Format == 0 {
+		return fmt.Sprintf("%d (0x%04x)", int16(v), uint16(v))
+	}
+	return m.FormatWord(uint16(v), w.Format)
+}
+
+/* Quotes up to n memory words from addr as characters, stopping at a zero word */
+func (m *mic1) MemString(addr int, n int) (string, error) {
+	if addr < 0 || addr >= len(m.Memory) {
+		return "", errors.New(fmt.Sprintf("address %d is outside of memory", addr))
+	}
+	s := make([]rune, 0, n)
+	for i := addr; i < addr+n && i < len(m.Memory) && m.Memory[i] != 0; i++ {
+		s = append(s, rune(m.Memory[i]&0xFF))
+	}
+	return strconv.Quote(string(s)), nil
+}
+
+/* Formats a word as x (hex), d (signed), u (unsigned), b (binary), c (character) or i (instruction) */
+func (m *mic1) FormatWord(v uint16, f byte) string {
+	switch f {
+	case 'x':
+		return fmt.Sprintf("0x%04x", v)
+	case 'd':
+		return fmt.Sprintf("%d", int16(v))
+	case 'u':
+		return fmt.Sprintf("%d", v)
+	case 'b':
+		return fmt.Sprintf("%016b", v)
+	case 'c':
+		return strconv.QuoteRune(rune(v & 0xFF))
+	case 'i':
+		return m.Disassemble(v)
+	}
+	return ""
+}